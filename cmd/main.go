@@ -2,23 +2,43 @@ package main
 
 import (
 	"database/sql/driver"
+	"flag"
+	"fmt"
 	"net"
 	"net/rpc"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/bendersilver/glog"
 	"github.com/bendersilver/pgcache/replica"
 	"github.com/bendersilver/pgcache/sqlite"
+	"github.com/jackc/pglogrepl"
 )
 
 var db *sqlite.Conn
 
+const waitTimeout = time.Second * 5
+
 // Query -
 type Query struct {
 	SQL  string
 	Args []driver.Value
+	// MinLSN - optional, wait until the cache has applied this LSN before running the query,
+	// an error in trigger capture mode
+	MinLSN  string
+	Timeout time.Duration
+}
+
+// WaitLSN -
+type WaitLSN struct {
+	LSN     string
+	Timeout time.Duration
 }
 
 // QueryResult -
@@ -39,8 +59,19 @@ func (d *DB) Exec(args *Query, r *int) error {
 	return db.Exec(args.SQL, args.Args...)
 }
 
+// WaitLSN - blocks until the applied LSN reaches args.LSN, replies with the applied LSN
+func (d *DB) WaitLSN(args *WaitLSN, r *string) error {
+	err := waitLSN(args.LSN, args.Timeout)
+	*r = replica.AppliedLSN().String()
+	return err
+}
+
 // Query -
 func (d *DB) Query(args *Query, r *QueryResult) error {
+	err := waitLSN(args.MinLSN, args.Timeout)
+	if err != nil {
+		return err
+	}
 	d.Lock()
 	defer d.Unlock()
 	rows, err := db.Query(args.SQL, args.Args...)
@@ -60,12 +91,188 @@ func (d *DB) Query(args *Query, r *QueryResult) error {
 	return rows.Err()
 }
 
+// Reload - applies the table config at path, the startup config if path is empty
+func (d *DB) Reload(path *string, r *int) error {
+	if *path == "" {
+		*path = configPath
+	}
+	return reload(*path)
+}
+
+// TableResync - reloads the cached table `<shema>.<table_name>` from a snapshot
+func (d *DB) TableResync(name *string, r *int) error {
+	return replica.TableResync(*name)
+}
+
+// Verify -
+type Verify struct {
+	Name      string
+	RangeSize int
+	Repair    bool
+}
+
+// Verify - compares the cached table with pg
+func (d *DB) Verify(args *Verify, r *replica.VerifyResult) error {
+	res, err := replica.Verify(args.Name, replica.VerifyOptions{
+		RangeSize: args.RangeSize,
+		Repair:    args.Repair,
+	})
+	if res != nil {
+		*r = *res
+	}
+	return err
+}
+
+// Status -
+func (d *DB) Status(args *int, r *replica.Status) error {
+	*r = *replica.GetStatus()
+	return nil
+}
+
+func waitLSN(lsn string, timeout time.Duration) error {
+	if lsn == "" {
+		return nil
+	}
+	l, err := pglogrepl.ParseLSN(lsn)
+	if err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		timeout = waitTimeout
+	}
+	return replica.WaitLSN(l, timeout)
+}
+
+var configPath string
+
+func reload(path string) error {
+	if path == "" {
+		return fmt.Errorf("server is not started with a config")
+	}
+	cfg, err := replica.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	return replica.Reload(cfg)
+}
+
+// watchConfig - reloads the config on SIGHUP
+func watchConfig() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		glog.Noticef("SIGHUP, reloading %s", configPath)
+		err := reload(configPath)
+		if err != nil {
+			glog.Error(err)
+		}
+	}
+}
+
 const sockAddr = "/tmp/pgcache.sock"
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	replica.SetSlotName("temp_test_slot")
-	err := replica.Run(os.Getenv("PG_URL"))
+	config := flag.String("config", os.Getenv("PG_CACHE_CONFIG"), "json config of the source and cached tables")
+	capture := flag.String("capture", os.Getenv("PG_CACHE_CAPTURE"), "file to record the replication stream to")
+	captureSize := flag.Int64("capture-size", 256<<20, "capture file size before rotation")
+	captureKeep := flag.Int("capture-keep", 4, "rotated capture files to keep")
+	replay := flag.String("replay", "", "comma separated capture files to apply instead of a live connection, oldest first")
+	replayUntil := flag.String("replay-until", "", "LSN to stop the replay at")
+	ndjson := flag.String("ndjson", "", "NDJSON file of change events to apply instead of a live connection")
+	flag.Parse()
+
+	if os.Getenv("TEMPORARY_SLOT") == "true" {
+		replica.SetTemporarySlot(true)
+	}
+	var err error
+	var batchSize int
+	var batchWindow time.Duration
+	if v := os.Getenv("PG_BATCH_SIZE"); v != "" {
+		batchSize, err = strconv.Atoi(v)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+	if v := os.Getenv("PG_BATCH_WINDOW"); v != "" {
+		batchWindow, err = time.ParseDuration(v)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+	replica.SetBatch(batchSize, batchWindow)
+	offline := *replay != "" || *ndjson != ""
+	if *capture != "" && !offline {
+		err = replica.SetCapture(*capture, *captureSize, *captureKeep)
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+	switch {
+	case *replay != "":
+		opt := replica.ReplayOptions{
+			Files: strings.Split(*replay, ","),
+			Until: *replayUntil,
+		}
+		if *config != "" {
+			opt.Config, err = replica.LoadConfig(*config)
+			if err != nil {
+				glog.Fatal(err)
+			}
+		}
+		err = replica.Replay(opt)
+	case *ndjson != "":
+		var cfg *replica.Config
+		if *config != "" {
+			cfg, err = replica.LoadConfig(*config)
+			if err != nil {
+				glog.Fatal(err)
+			}
+		}
+		var f *os.File
+		f, err = os.Open(*ndjson)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		err = replica.RunSource(replica.NewNDJSONSource(f), cfg)
+		f.Close()
+	case *config != "":
+		var cfg *replica.Config
+		cfg, err = replica.LoadConfig(*config)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if cfg.DSN == "" {
+			cfg.DSN = os.Getenv("PG_URL")
+		}
+		err = replica.RunConfig(cfg)
+		configPath = *config
+		go watchConfig()
+	default:
+		if v := os.Getenv("PG_SLOT"); v != "" {
+			replica.SetSlotName(v)
+		}
+		if v := os.Getenv("PG_PUBLICATION"); v != "" {
+			replica.SetPublication(v)
+		}
+		if v := os.Getenv("PG_APPLICATION_NAME"); v != "" {
+			replica.SetApplicationName(v)
+		}
+		replica.SetExternalPublication(os.Getenv("PG_EXTERNAL_PUBLICATION") == "true")
+		if v := os.Getenv("PG_PLUGIN"); v != "" {
+			err = replica.SetPlugin(v)
+			if err != nil {
+				glog.Fatal(err)
+			}
+		}
+		if v := os.Getenv("PG_CAPTURE"); v != "" {
+			err = replica.SetCaptureMode(v)
+			if err != nil {
+				glog.Fatal(err)
+			}
+		}
+		err = replica.Run(os.Getenv("PG_URL"))
+	}
 	if err != nil {
 		glog.Fatal(err)
 	}
@@ -73,6 +280,19 @@ func main() {
 	if err != nil {
 		glog.Fatal(err)
 	}
+	if v := os.Getenv("VERIFY_INTERVAL"); v != "" && !offline {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		err = replica.StartVerifier(replica.VerifyOptions{
+			Interval: interval,
+			Repair:   os.Getenv("VERIFY_REPAIR") == "true",
+		})
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
 
 	listener, err := net.Listen("unix", sockAddr)
 	if err != nil {
@@ -0,0 +1,189 @@
+package replica
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"sync"
+	"time"
+
+	"github.com/bendersilver/glog"
+	"github.com/jackc/pglogrepl"
+)
+
+// batchSize - changes per sqlite transaction, a larger source transaction is committed in parts
+var batchSize = 10000
+
+// batchWindow - the longest time a change waits for the sqlite commit
+var batchWindow = time.Millisecond * 100
+
+// SetBatch - changes per sqlite transaction and the longest time a change waits for the commit.
+// Readers see the changes and WaitLSN returns once they are committed.
+func SetBatch(size int, window time.Duration) {
+	mx.Lock()
+	defer mx.Unlock()
+	if size > 0 {
+		batchSize = size
+	}
+	if window > 0 {
+		batchWindow = window
+	}
+}
+
+// batch - open sqlite transaction of the applied changes
+type batch struct {
+	open    bool
+	changes int
+	started time.Time
+	// commit - end of the last source transaction in the batch
+	commit pglogrepl.LSN
+	// held, heldC - last update, merged with the next update of the same row
+	held  *relationItem
+	heldC *change
+}
+
+var flusher sync.Once
+
+// startFlusher - commits the batch left open when the stream goes idle
+func startFlusher() {
+	flusher.Do(func() {
+		mx.Lock()
+		tick := time.Tick(batchWindow)
+		mx.Unlock()
+		go func() {
+			for range tick {
+				r.flushIdle()
+			}
+		}()
+	})
+}
+
+// flushIdle - commits the batch open for longer than the window
+func (r *replication) flushIdle() {
+	mx.Lock()
+	defer mx.Unlock()
+	if r.batch.open && time.Since(r.batch.started) >= batchWindow {
+		r.flush()
+	}
+}
+
+// write - applies the change in the open batch, consecutive updates of one row are collapsed into one
+func (r *replication) write(ri *relationItem, c *change) {
+	b := &r.batch
+	if b.held != nil {
+		if c.kind == EventUpdate && b.held == ri && sameValue(b.heldC.row[ri.pkPos], c.key) {
+			b.heldC = &change{kind: EventUpdate, row: copyValues(c.row), key: b.heldC.key}
+			return
+		}
+		r.release()
+	}
+	r.begin()
+	// without a batch the update is written at once, commit advances applied right away
+	if c.kind == EventUpdate && b.open {
+		key := copyValues([]driver.Value{c.key})[0]
+		b.held, b.heldC = ri, &change{kind: EventUpdate, row: copyValues(c.row), key: key}
+		return
+	}
+	err := ri.exec(c)
+	if err != nil {
+		glog.Error(err)
+	}
+	r.written()
+}
+
+// begin - opens the batch transaction if it is not open yet
+func (r *replication) begin() {
+	b := &r.batch
+	if b.open {
+		return
+	}
+	err := db.Exec("BEGIN;")
+	if err != nil {
+		// the changes are written in autocommit mode
+		glog.Errorf("sqlite begin err: %v", err)
+		return
+	}
+	b.open, b.changes, b.started = true, 0, time.Now()
+}
+
+// release - writes the held update
+func (r *replication) release() {
+	b := &r.batch
+	if b.held == nil {
+		return
+	}
+	err := b.held.exec(b.heldC)
+	if err != nil {
+		glog.Error(err)
+	}
+	b.held, b.heldC = nil, nil
+	r.written()
+}
+
+// written - commits the batch when it is full
+func (r *replication) written() {
+	r.batch.changes++
+	if r.batch.changes >= batchSize {
+		r.flush()
+	}
+}
+
+// commit - end of a source transaction or a keepalive position. The transaction
+// is applied with the sqlite commit of its batch, at once if no batch is open.
+func (r *replication) commit(lsn pglogrepl.LSN) {
+	b := &r.batch
+	if !b.open {
+		r.advance(lsn)
+		return
+	}
+	b.commit = lsn
+	if b.changes >= batchSize || time.Since(b.started) >= batchWindow {
+		r.flush()
+	}
+}
+
+// flush - commits the open batch, mx must be held. Everything that writes sqlite or
+// closes relation items outside the stream flushes first.
+func (r *replication) flush() {
+	b := &r.batch
+	if b.held != nil {
+		err := b.held.exec(b.heldC)
+		if err != nil {
+			glog.Error(err)
+		}
+		b.held, b.heldC = nil, nil
+	}
+	if b.open {
+		err := db.Exec("COMMIT;")
+		if err != nil {
+			glog.Errorf("sqlite commit err: %v", err)
+		}
+		b.open = false
+	}
+	if b.commit != 0 {
+		r.advance(b.commit)
+		b.commit = 0
+	}
+}
+
+// advance - the transactions up to lsn are committed in sqlite
+func (r *replication) advance(lsn pglogrepl.LSN) {
+	r.applied.advance(lsn)
+	if lsn > r.flushed {
+		r.flushed = lsn
+	}
+}
+
+// sameValue - decoded values are equal
+func sameValue(a, b driver.Value) bool {
+	switch x := a.(type) {
+	case []byte:
+		y, ok := b.([]byte)
+		return ok && bytes.Equal(x, y)
+	case time.Time:
+		y, ok := b.(time.Time)
+		return ok && x.Equal(y)
+	case int64, float64, bool, string:
+		return a == b
+	}
+	return false
+}
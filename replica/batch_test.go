@@ -0,0 +1,156 @@
+package replica
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// setBatch - sets the batch limits under mx for the test, the flusher reads them
+func setBatch(t *testing.T, size int, window time.Duration) {
+	mx.Lock()
+	prevSize, prevWindow := batchSize, batchWindow
+	batchSize, batchWindow = size, window
+	mx.Unlock()
+	t.Cleanup(func() {
+		mx.Lock()
+		batchSize, batchWindow = prevSize, prevWindow
+		mx.Unlock()
+	})
+}
+
+// batchRun - relation items of a new namespace sent to the stream, base is above applied
+func batchRun(t *testing.T) (string, pglogrepl.LSN) {
+	t.Helper()
+	runEvents(t, nil)
+	// the next RunSource opens a new connection, the batch must not stay open on this one
+	t.Cleanup(flushBatch)
+	sourceRuns++
+	ns := fmt.Sprintf("run%d", sourceRuns)
+	sendEvents(t, itemsRelation(1, ns))
+	return ns, pglogrepl.LSN(1000 * sourceRuns)
+}
+
+// sendEvents - applies the events one by one like the stream
+func sendEvents(t *testing.T, events ...*Event) {
+	t.Helper()
+	for _, ev := range events {
+		err := r.event(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func flushBatch() {
+	mx.Lock()
+	r.flush()
+	mx.Unlock()
+}
+
+func TestBatchSize(t *testing.T) {
+	setBatch(t, 3, time.Hour)
+	ns, base := batchRun(t)
+	prev := r.applied.get()
+
+	sendEvents(t, txEvents(base+10,
+		insertEvent(1, int64(1), "a", int64(1)),
+		insertEvent(1, int64(2), "b", int64(2)),
+	)...)
+	if got := r.applied.get(); got != prev {
+		t.Errorf("applied %s before the batch is full, want %s", got, prev)
+	}
+	// the third change fills the batch inside the second transaction
+	sendEvents(t, txEvents(base+20,
+		insertEvent(1, int64(3), "c", int64(3)),
+		insertEvent(1, int64(4), "d", int64(4)),
+	)...)
+	if got := r.applied.get(); got != base+10 {
+		t.Errorf("applied %s, want %s", got, base+10)
+	}
+	mx.Lock()
+	open, changes := r.batch.open, r.batch.changes
+	mx.Unlock()
+	if !open || changes != 1 {
+		t.Errorf("batch open %v with %d changes, want 1 open", open, changes)
+	}
+	flushBatch()
+	if got := r.applied.get(); got != base+20 {
+		t.Errorf("applied %s after flush, want %s", got, base+20)
+	}
+	want := []string{"1 a 1", "2 b 2", "3 c 3", "4 d 4"}
+	if rows := cachedRows(t, ns+"_items"); !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows %q, want %q", rows, want)
+	}
+}
+
+func TestBatchWindow(t *testing.T) {
+	setBatch(t, 1000, time.Hour)
+	_, base := batchRun(t)
+
+	sendEvents(t, txEvents(base+10, insertEvent(1, int64(1), "a", int64(1)))...)
+	if got := r.applied.get(); got == base+10 {
+		t.Fatalf("applied %s before the window ends", got)
+	}
+	// a commit after the window commits the batch
+	expire := func() {
+		mx.Lock()
+		r.batch.started = time.Now().Add(-time.Hour * 2)
+		mx.Unlock()
+	}
+	sendEvents(t, &Event{Kind: EventBegin}, insertEvent(1, int64(2), "b", int64(2)))
+	expire()
+	sendEvents(t, &Event{Kind: EventCommit, LSN: base + 20})
+	if got := r.applied.get(); got != base+20 {
+		t.Errorf("applied %s, want %s", got, base+20)
+	}
+
+	// an idle batch is committed by the flusher
+	sendEvents(t, txEvents(base+30, insertEvent(1, int64(3), "c", int64(3)))...)
+	r.flushIdle()
+	if got := r.applied.get(); got != base+20 {
+		t.Errorf("applied %s inside the window, want %s", got, base+20)
+	}
+	expire()
+	r.flushIdle()
+	if got := r.applied.get(); got != base+30 {
+		t.Errorf("applied %s after the window, want %s", got, base+30)
+	}
+}
+
+func TestBatchCollapse(t *testing.T) {
+	setBatch(t, 1000, time.Hour)
+	ns, base := batchRun(t)
+	sendEvents(t, txEvents(base+10,
+		insertEvent(1, int64(1), "a", int64(1)),
+		insertEvent(1, int64(2), "b", int64(2)),
+	)...)
+	flushBatch()
+
+	sendEvents(t,
+		&Event{Kind: EventBegin},
+		updateEvent(1, keyRow(int64(1), nil, nil), int64(10), "a", int64(1)),
+		updateEvent(1, nil, int64(10), "a2", int64(5)),
+		updateEvent(1, keyRow(int64(10), nil, nil), int64(20), "a3", int64(6)),
+		// another row writes the held update
+		updateEvent(1, nil, int64(2), "b2", int64(7)),
+	)
+	mx.Lock()
+	changes, held := r.batch.changes, r.batch.heldC
+	mx.Unlock()
+	if changes != 1 {
+		t.Errorf("%d changes written, want the 3 updates of one row as 1", changes)
+	}
+	if held == nil || !reflect.DeepEqual(held.row, keyRow(int64(2), "b2", int64(7))) {
+		t.Errorf("held update %+v, want the row 2", held)
+	}
+	sendEvents(t, &Event{Kind: EventCommit, LSN: base + 20})
+	flushBatch()
+	want := []string{"2 b2 7", "20 a3 6"}
+	if rows := cachedRows(t, ns+"_items"); !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows %q, want %q", rows, want)
+	}
+}
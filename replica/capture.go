@@ -0,0 +1,142 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// captureMagic - header of every capture file.
+// A record is the receive time in unix nanoseconds (int64), the data length (uint32) and the CopyData payload.
+var captureMagic = []byte("PGCCAP01")
+
+// capture - writes the received replication messages to a rotating file
+type capture struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+}
+
+var capt *capture
+
+// SetCapture - writes every CopyData message received from pg to path.
+// The file is rotated to path.1 ... path.<keep> when it grows over maxSize bytes, path.1 is the newest.
+// A file left with records by the previous run is rotated too, after a crash it is the one to replay.
+func SetCapture(path string, maxSize int64, keep int) error {
+	if maxSize <= 0 {
+		maxSize = 256 << 20
+	}
+	if keep <= 0 {
+		keep = 4
+	}
+	c := &capture{path: path, maxSize: maxSize, keep: keep}
+	var err error
+	if fi, e := os.Stat(path); e == nil && fi.Size() > int64(len(captureMagic)) {
+		err = c.rotate()
+	} else {
+		err = c.open()
+	}
+	if err != nil {
+		return err
+	}
+	capt = c
+	return nil
+}
+
+func (c *capture) open() (err error) {
+	c.f, err = os.OpenFile(c.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("capture open err: %v", err)
+	}
+	c.w = bufio.NewWriter(c.f)
+	_, err = c.w.Write(captureMagic)
+	c.size = int64(len(captureMagic))
+	return err
+}
+
+// rotate - shifts path.N to path.N+1, drops the oldest file and starts a new one
+func (c *capture) rotate() error {
+	err := c.close()
+	if err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", c.path, c.keep))
+	for i := c.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", c.path, i), fmt.Sprintf("%s.%d", c.path, i+1))
+	}
+	err = os.Rename(c.path, c.path+".1")
+	if err != nil {
+		return fmt.Errorf("capture rotate err: %v", err)
+	}
+	return c.open()
+}
+
+// write - the record is flushed, so a crash loses at most the last message
+func (c *capture) write(t time.Time, data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.size >= c.maxSize {
+		err := c.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	var head [12]byte
+	binary.BigEndian.PutUint64(head[:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(head[8:], uint32(len(data)))
+	c.w.Write(head[:])
+	c.w.Write(data)
+	c.size += int64(len(head) + len(data))
+	return c.w.Flush()
+}
+
+func (c *capture) close() error {
+	if c.f == nil {
+		return nil
+	}
+	err := c.w.Flush()
+	if err != nil {
+		c.f.Close()
+		return err
+	}
+	return c.f.Close()
+}
+
+// captureReader - reads the records of a capture file
+type captureReader struct {
+	r *bufio.Reader
+}
+
+func newCaptureReader(f io.Reader) (*captureReader, error) {
+	cr := &captureReader{r: bufio.NewReader(f)}
+	magic := make([]byte, len(captureMagic))
+	_, err := io.ReadFull(cr.r, magic)
+	if err != nil || string(magic) != string(captureMagic) {
+		return nil, fmt.Errorf("not a capture file")
+	}
+	return cr, nil
+}
+
+// next - io.EOF after the last record, io.ErrUnexpectedEOF if the last record is cut
+func (cr *captureReader) next() (t time.Time, data []byte, err error) {
+	var head [12]byte
+	_, err = io.ReadFull(cr.r, head[:])
+	if err != nil {
+		return
+	}
+	t = time.Unix(0, int64(binary.BigEndian.Uint64(head[:8])))
+	data = make([]byte, binary.BigEndian.Uint32(head[8:]))
+	_, err = io.ReadFull(cr.r, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
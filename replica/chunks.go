@@ -0,0 +1,350 @@
+package replica
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bendersilver/glog"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// chunkRetries - reconnects in a row before a chunked load fails
+const chunkRetries = 10
+
+// LoadProgress - state of a chunked initial load
+type LoadProgress struct {
+	Name    string
+	Target  string
+	Started time.Time
+	Chunks  int
+	Rows    int64
+	Bytes   int64
+	// EstimatedRows - pg statistics of the table at the start, 0 if unknown
+	EstimatedRows int64
+	// ETA - time left by the rows per second so far, 0 if unknown
+	ETA time.Duration
+	// Retries - reconnects after connection failures
+	Retries int
+}
+
+// loads - chunked loads in progress by sqlite name, mx must be held
+var loads = make(map[string]*chunkLoad)
+
+// chunkLoad - table loaded by key ranges. The chunks are read from different snapshots,
+// the changes streamed from the start of the load are kept and replayed over all of them.
+type chunkLoad struct {
+	changeLog
+	opt *AddOptions
+	// keyType - sql name of the key column type
+	keyType  string
+	progress LoadProgress
+	logged   time.Time
+}
+
+func copyValues(vals []driver.Value) []driver.Value {
+	if vals == nil {
+		return nil
+	}
+	row := make([]driver.Value, len(vals))
+	for i, v := range vals {
+		if b, ok := v.([]byte); ok {
+			v = append([]byte(nil), b...)
+		}
+		row[i] = v
+	}
+	return row
+}
+
+// checkChunks - chunks are key ranges of the pg table, a query has no key
+func (o *AddOptions) checkChunks() error {
+	if o.ChunkSize < 0 || o.ChunkSize > 0 && o.Query != "" {
+		return fmt.Errorf("table %s: chunk size must be positive and can't be used with a query", o.TableName)
+	}
+	return nil
+}
+
+// logLoad - keeps the change for the chunked loads of its table, mx must be held
+func (r *replication) logLoad(relID uint32, ev *Event) {
+	if len(loads) == 0 {
+		return
+	}
+	ri, ok := r.relations[relID]
+	if !ok {
+		return
+	}
+	for _, l := range loads {
+		if !l.opt.matches(ri.rel.Namespace, ri.rel.Name) {
+			continue
+		}
+		if ev.Kind == EventTruncate {
+			if !l.opt.IgnoreTruncate {
+				l.add(ri.rel, &Event{Kind: EventTruncate, LSN: ev.LSN})
+			}
+			continue
+		}
+		l.add(ri.rel, ev)
+	}
+}
+
+// loading - the pg table or partition is in a chunked load, mx must be held
+func loading(shema, table string) bool {
+	for _, l := range loads {
+		if l.opt.matches(shema, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// addChunked - loads a new table into a staging copy ChunkSize rows at a time and renames it into place.
+// The stream goes on between the chunks, a lost connection is reopened and the load resumes
+// after the last finished chunk.
+func addChunked(conn *pgconn.PgConn, opt *AddOptions) (err error) {
+	target := opt.tableName()
+	staging := target + "__staging"
+	start := time.Now()
+
+	key, oid, _, err := tableKey(conn, opt)
+	if err != nil {
+		return err
+	}
+	key = quoteIdent(key)
+	typ, err := typeName(conn, oid)
+	if err != nil {
+		return err
+	}
+	est, err := estimateRows(conn, opt)
+	if err != nil {
+		glog.Warningf("load %s: %v", opt.TableName, err)
+	}
+
+	l := &chunkLoad{
+		opt:     opt,
+		keyType: typ,
+		logged:  start,
+		progress: LoadProgress{
+			Name:          opt.TableName,
+			Target:        target,
+			Started:       start,
+			EstimatedRows: est,
+		},
+	}
+	mx.Lock()
+	if _, ok := loads[target]; ok {
+		mx.Unlock()
+		return fmt.Errorf("table %s is already loading", opt.TableName)
+	}
+	loads[target] = l
+	// wal2json streams the table from now on
+	r.restartStream()
+	var t *tmpTable
+	err = db.Exec("DROP TABLE IF EXISTS " + quoteTarget(staging) + ";")
+	if err == nil {
+		t, err = createTable(conn, opt, staging)
+	}
+	mx.Unlock()
+	defer func() {
+		if err != nil {
+			mx.Lock()
+			delete(loads, target)
+			db.Exec("DROP TABLE IF EXISTS " + quoteTarget(staging) + ";")
+			mx.Unlock()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	defer t.insert.Close()
+
+	c := conn
+	defer func() {
+		if c != conn {
+			c.Close(ctx)
+		}
+	}()
+	var from []byte
+	var hasFrom bool
+	var failed int
+	for {
+		to, hasTo, err := chunkBound(c, opt, key, from, hasFrom)
+		if err == nil {
+			err = l.chunk(c, t, key, from, hasFrom, to, hasTo)
+		}
+		if err != nil {
+			if !c.IsClosed() {
+				return err
+			}
+			for {
+				failed++
+				if failed > chunkRetries {
+					return err
+				}
+				glog.Warningf("load %s: %v, resuming after %d rows", opt.TableName, err, t.rows)
+				time.Sleep(time.Second * 5)
+				if c != conn {
+					c.Close(ctx)
+				}
+				c, err = pgConnect()
+				if err == nil {
+					break
+				}
+				c = conn
+			}
+			mx.Lock()
+			l.progress.Retries++
+			mx.Unlock()
+			continue
+		}
+		failed = 0
+		if !hasTo {
+			break
+		}
+		from, hasFrom = to, true
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+	r.flush()
+	delete(loads, target)
+	err = l.replay(staging, opt)
+	if err == nil {
+		err = swap(staging, target)
+	}
+	if err != nil {
+		db.Exec("DROP TABLE IF EXISTS " + quoteTarget(staging) + ";")
+		return err
+	}
+	glog.Noticef("loaded %s: %d rows, %s in %d chunks, %d changes replayed, %v",
+		opt.TableName, t.rows, byteSize(t.bytes), l.progress.Chunks, len(l.events), time.Since(start).Round(time.Second))
+	loaded(opt, start)
+	tables[target] = opt
+	r.retarget(opt)
+	r.restartStream()
+	return nil
+}
+
+// chunkBound - key of the last row of the next chunk in pg text format, hasTo is false for the last chunk
+func chunkBound(conn *pgconn.PgConn, opt *AddOptions, key string, from []byte, hasFrom bool) (to []byte, hasTo bool, err error) {
+	where := "true"
+	var params [][]byte
+	if hasFrom {
+		where = key + " > $1"
+		params = append(params, from)
+	}
+	res := conn.ExecParams(ctx, fmt.Sprintf("SELECT %s::text FROM %s WHERE %s ORDER BY %s OFFSET %d LIMIT 1;",
+		key, quoteTable(opt.shema, opt.table), where, key, opt.ChunkSize-1), params, nil, nil, nil).Read()
+	if res.Err != nil {
+		return nil, false, fmt.Errorf("pg get chunk bound err: %v", res.Err)
+	}
+	if len(res.Rows) == 0 {
+		return nil, false, nil
+	}
+	return append([]byte(nil), res.Rows[0][0]...), true, nil
+}
+
+// chunk - copies the rows of (from, to] in one sqlite transaction, a failed chunk leaves no rows
+func (l *chunkLoad) chunk(conn *pgconn.PgConn, t *tmpTable, key string, from []byte, hasFrom bool, to []byte, hasTo bool) error {
+	// COPY takes no parameters, the bounds are literals cast to the key type
+	// so they compare like the $1 of chunkBound
+	where := "true"
+	if hasFrom {
+		where = key + " > " + quoteLiteral(string(from)) + "::" + l.keyType
+	}
+	if hasTo {
+		where += " AND " + key + " <= " + quoteLiteral(string(to)) + "::" + l.keyType
+	}
+	sql := fmt.Sprintf("COPY (%s WHERE %s) TO STDOUT WITH BINARY;", l.opt.source(), where)
+
+	mx.Lock()
+	defer mx.Unlock()
+	// a failed chunk must not roll back the stream
+	r.flush()
+	rows, bytes := t.rows, t.bytes
+	err := db.Exec("SAVEPOINT chunk;")
+	if err != nil {
+		return err
+	}
+	err = t.copy(conn, sql)
+	if err != nil {
+		db.Exec("ROLLBACK TO chunk;")
+		db.Exec("RELEASE chunk;")
+		t.rows, t.bytes = rows, bytes
+		return fmt.Errorf("copy err: %v", err)
+	}
+	err = db.Exec("RELEASE chunk;")
+	if err != nil {
+		return err
+	}
+
+	p := &l.progress
+	p.Chunks++
+	p.Rows, p.Bytes = t.rows, t.bytes
+	elapsed := time.Since(p.Started)
+	if p.EstimatedRows > p.Rows && p.Rows > 0 {
+		p.ETA = time.Duration(float64(elapsed) * float64(p.EstimatedRows-p.Rows) / float64(p.Rows)).Round(time.Second)
+	} else {
+		p.ETA = 0
+	}
+	if time.Since(l.logged) >= time.Second*10 || !hasTo {
+		l.logged = time.Now()
+		glog.Noticef("load %s: %d/%d rows, %s, eta %v", p.Name, p.Rows, p.EstimatedRows, byteSize(p.Bytes), p.ETA)
+	}
+	return nil
+}
+
+// typeName - sql name of the type, quoted where needed
+func typeName(conn *pgconn.PgConn, oid uint32) (string, error) {
+	res := conn.ExecParams(ctx, "SELECT pg_catalog.format_type($1::oid, NULL);",
+		[][]byte{[]byte(strconv.FormatUint(uint64(oid), 10))}, nil, nil, nil).Read()
+	if res.Err != nil {
+		return "", fmt.Errorf("pg get type name err: %v", res.Err)
+	}
+	if len(res.Rows) == 0 || len(res.Rows[0][0]) == 0 {
+		return "", fmt.Errorf("type %d not found", oid)
+	}
+	return string(res.Rows[0][0]), nil
+}
+
+// estimateRows - row count of the pg statistics, partitioned tables sum their leaves
+func estimateRows(conn *pgconn.PgConn, opt *AddOptions) (int64, error) {
+	rels := opt.leaves
+	if len(rels) == 0 {
+		rels = []pgRelation{{opt.shema, opt.table}}
+	}
+	var n int64
+	for _, rel := range rels {
+		res := conn.ExecParams(ctx, `
+			SELECT greatest(reltuples, 0)::bigint::text
+			FROM pg_catalog.pg_class
+			WHERE oid = $1::regclass;
+			`, [][]byte{[]byte(quoteTable(rel.shema, rel.table))}, nil, nil, nil).Read()
+		if res.Err != nil {
+			return 0, fmt.Errorf("pg get reltuples err: %v", res.Err)
+		}
+		if len(res.Rows) == 0 {
+			continue
+		}
+		v, err := strconv.ParseInt(string(res.Rows[0][0]), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		n += v
+	}
+	return n, nil
+}
+
+// byteSize - n in binary units
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,54 @@
+package replica
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+)
+
+func TestChunkedLoadRelation(t *testing.T) {
+	sourceRuns++
+	ns := fmt.Sprintf("run%d", sourceRuns)
+	opt := &AddOptions{TableName: ns + ".items"}
+	err := opt.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &chunkLoad{opt: opt}
+	mx.Lock()
+	loads[opt.tableName()] = l
+	mx.Unlock()
+	defer func() {
+		mx.Lock()
+		delete(loads, opt.tableName())
+		mx.Unlock()
+	}()
+
+	base := pglogrepl.LSN(1000 * sourceRuns)
+	runEvents(t, nil, append([]*Event{itemsRelation(1, ns)}, txEvents(base+10,
+		insertEvent(1, int64(1), "a", int64(5)),
+		&Event{Kind: EventTruncate, RelationIDs: []uint32{1}},
+		deleteEvent(1, int64(1), nil, nil),
+	)...)...)
+
+	// only the staging table exists during the load, the changes are kept for its replay
+	mx.Lock()
+	ri := r.relations[1]
+	mx.Unlock()
+	if !ri.skipped() {
+		t.Errorf("relation is written to %s", ri.tableName)
+	}
+	rows, err := db.Query(fmt.Sprintf("SELECT name FROM sqlite_master WHERE name = %s;", quoteLiteral(ns+"_items")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := rows.Next()
+	rows.Close()
+	if created {
+		t.Errorf("table %s_items is created", ns)
+	}
+	if len(l.events) != 3 {
+		t.Errorf("%d changes kept, want 3", len(l.events))
+	}
+}
@@ -0,0 +1,355 @@
+package replica
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bendersilver/glog"
+)
+
+// Config - source and cached tables
+type Config struct {
+	// DSN - source database url
+	DSN  string `json:"dsn"`
+	Slot string `json:"slot"`
+	// Plugin - pgoutput (default) or wal2json
+	Plugin string `json:"plugin"`
+	// Capture - logical (default) or trigger for servers without logical replication
+	Capture string `json:"capture"`
+	// TemporarySlot - the slot is dropped with the connection, reconnects reload the tables
+	TemporarySlot bool   `json:"temporary_slot"`
+	Publication   string `json:"publication"`
+	// ExternalPublication - the publication is managed by the DBAs and is never altered
+	ExternalPublication bool   `json:"external_publication"`
+	ApplicationName     string `json:"application_name"`
+	// BatchSize, BatchWindow - changes per sqlite transaction and the longest wait for its commit, e.g. "100ms"
+	BatchSize   int           `json:"batch_size"`
+	BatchWindow string        `json:"batch_window"`
+	Tables      []TableConfig `json:"tables"`
+}
+
+// TableConfig - AddOptions of a cached table
+type TableConfig struct {
+	// Name - `<shema>.<table_name>`
+	Name string `json:"name"`
+	// InitData - copy the rows on start, true if omitted
+	InitData     *bool    `json:"init_data"`
+	Query        string   `json:"query"`
+	Columns      []string `json:"columns"`
+	Target       string   `json:"target"`
+	AttachSchema bool     `json:"attach_schema"`
+	// Expressions - sqlite expressions of the stored column values
+	Expressions map[string]string `json:"expressions"`
+	Computed    []ComputedColumn  `json:"computed"`
+	// IgnoreTruncate - keep the rows when the pg table is truncated, e.g. for history
+	IgnoreTruncate bool `json:"ignore_truncate"`
+	// ChunkSize - rows per chunk of a resumable initial load
+	ChunkSize int `json:"chunk_size"`
+	// IfExists - keep, refresh or error
+	IfExists string `json:"if_exists"`
+	// Refresh - reload interval, e.g. "15m", the table is not streamed
+	Refresh string `json:"refresh"`
+	// RefreshCron - reload schedule, e.g. "0 3 * * *", instead of Refresh
+	RefreshCron string `json:"refresh_cron"`
+}
+
+// LoadConfig - reads a json config file
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("config %s err: %v", path, err)
+	}
+	return &cfg, cfg.validate()
+}
+
+func (c *Config) validate() error {
+	targets := make(map[string]string)
+	for _, t := range c.Tables {
+		opt, err := t.options()
+		if err != nil {
+			return err
+		}
+		err = opt.parse()
+		if err != nil {
+			return err
+		}
+		err = opt.checkTransform()
+		if err != nil {
+			return err
+		}
+		err = opt.checkRefresh()
+		if err != nil {
+			return err
+		}
+		err = opt.checkChunks()
+		if err != nil {
+			return err
+		}
+		if name, ok := targets[opt.tableName()]; ok {
+			return fmt.Errorf("tables %s and %s have the same target %s", name, t.Name, opt.tableName())
+		}
+		targets[opt.tableName()] = t.Name
+	}
+	return nil
+}
+
+func (t *TableConfig) options() (*AddOptions, error) {
+	opt := &AddOptions{
+		TableName:      t.Name,
+		InitData:       t.InitData == nil || *t.InitData,
+		Query:          t.Query,
+		Columns:        t.Columns,
+		Target:         t.Target,
+		AttachSchema:   t.AttachSchema,
+		Expressions:    t.Expressions,
+		Computed:       t.Computed,
+		RefreshCron:    t.RefreshCron,
+		IgnoreTruncate: t.IgnoreTruncate,
+		ChunkSize:      t.ChunkSize,
+	}
+	if t.Refresh != "" {
+		var err error
+		opt.Refresh, err = time.ParseDuration(t.Refresh)
+		if err != nil {
+			return nil, fmt.Errorf("table %s: refresh err: %v", t.Name, err)
+		}
+	}
+	switch t.IfExists {
+	case "", "keep":
+		opt.IfExists = ExistsKeep
+	case "refresh":
+		opt.IfExists = ExistsRefresh
+	case "error":
+		opt.IfExists = ExistsError
+	default:
+		return nil, fmt.Errorf("table %s: unknown if_exists %q", t.Name, t.IfExists)
+	}
+	return opt, nil
+}
+
+// applied - last applied config
+var applied struct {
+	sync.Mutex
+	cfg *Config
+}
+
+// setBatch - batch settings of the config, unset ones keep their defaults
+func (c *Config) setBatch() error {
+	var window time.Duration
+	if c.BatchWindow != "" {
+		var err error
+		window, err = time.ParseDuration(c.BatchWindow)
+		if err != nil {
+			return fmt.Errorf("batch window %q: %v", c.BatchWindow, err)
+		}
+	}
+	SetBatch(c.BatchSize, window)
+	return nil
+}
+
+// RunConfig - starts replication and caches the configured tables.
+// The publication is kept, tables that are not configured are removed from it.
+func RunConfig(cfg *Config) error {
+	if cfg.Slot != "" {
+		SetSlotName(cfg.Slot)
+	}
+	if cfg.Plugin != "" {
+		err := SetPlugin(cfg.Plugin)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Capture != "" {
+		err := SetCaptureMode(cfg.Capture)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Publication != "" {
+		SetPublication(cfg.Publication)
+	}
+	if cfg.TemporarySlot {
+		SetTemporarySlot(true)
+	}
+	if cfg.ExternalPublication {
+		SetExternalPublication(true)
+	}
+	if cfg.ApplicationName != "" {
+		SetApplicationName(cfg.ApplicationName)
+	}
+	err := cfg.setBatch()
+	if err != nil {
+		return err
+	}
+	err = start(cfg.DSN, true)
+	if err != nil {
+		return err
+	}
+	for _, t := range cfg.Tables {
+		opt, err := t.options()
+		if err != nil {
+			return err
+		}
+		err = TableAdd(opt)
+		if err != nil {
+			return fmt.Errorf("table %s err: %v", t.Name, err)
+		}
+	}
+	applied.Lock()
+	applied.cfg = cfg
+	applied.Unlock()
+	return reconcile()
+}
+
+// Reload - applies the tables of a changed config while replication keeps going.
+// New tables are added, removed ones dropped, changed ones reloaded from a snapshot.
+func Reload(cfg *Config) error {
+	err := cfg.validate()
+	if err != nil {
+		return err
+	}
+	applied.Lock()
+	defer applied.Unlock()
+	if applied.cfg == nil {
+		return fmt.Errorf("replication is not started from a config")
+	}
+	prev := applied.cfg
+	source := *cfg
+	source.DSN, source.Tables = prev.DSN, prev.Tables
+	if cfg.DSN != "" && cfg.DSN != prev.DSN || !reflect.DeepEqual(&source, prev) {
+		glog.Warning("source, slot and publication changes need a restart, only tables are reloaded")
+	}
+
+	old := make(map[pgRelation]TableConfig)
+	for _, t := range prev.Tables {
+		shema, table, _ := parseTableName(t.Name)
+		old[pgRelation{shema, table}] = t
+	}
+
+	var errs []string
+	fail := func(name string, err error) {
+		glog.Errorf("reload table %s err: %v", name, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+	}
+	// cached - entries of the tables as they are cached now, a failed change keeps the previous one
+	var cached []TableConfig
+	var added, dropped, changed int
+	for _, t := range cfg.Tables {
+		shema, table, _ := parseTableName(t.Name)
+		rel := pgRelation{shema, table}
+		pt, ok := old[rel]
+		delete(old, rel)
+		if ok && reflect.DeepEqual(pt, t) {
+			cached = append(cached, t)
+			continue
+		}
+		opt, _ := t.options()
+		if ok {
+			changed++
+			popt, _ := pt.options()
+			popt.parse()
+			opt.parse()
+			if popt.tableName() != opt.tableName() {
+				err = TableDrop(pt.Name)
+				if err != nil {
+					fail(pt.Name, err)
+					cached = append(cached, pt)
+					continue
+				}
+				// nothing is cached if the add fails
+				ok = false
+			} else {
+				opt.IfExists = ExistsRefresh
+			}
+		} else {
+			added++
+		}
+		err = TableAdd(opt)
+		if err != nil {
+			fail(t.Name, err)
+			if ok {
+				// the refresh failed, the previous load stays
+				cached = append(cached, pt)
+			}
+			continue
+		}
+		cached = append(cached, t)
+	}
+	for _, t := range old {
+		dropped++
+		err = TableDrop(t.Name)
+		if err != nil {
+			fail(t.Name, err)
+			cached = append(cached, t)
+		}
+	}
+	glog.Noticef("config reloaded: %d tables added, %d changed, %d dropped", added, changed, dropped)
+
+	next := *prev
+	next.Tables = cached
+	applied.cfg = &next
+	if len(errs) > 0 {
+		return fmt.Errorf("reload errors: %s", strings.Join(errs, "; "))
+	}
+	return reconcile()
+}
+
+// reconcile - drops the published relations that don't belong to a cached table
+func reconcile() error {
+	if captureMode == captureTrigger {
+		conn, err := pgConnect()
+		if err != nil {
+			return fmt.Errorf("pg connerct err: %v", err)
+		}
+		defer conn.Close(ctx)
+		return reconcileTriggers(conn)
+	}
+	if !managedPublication() {
+		return nil
+	}
+	conn, err := pgConnect()
+	if err != nil {
+		return fmt.Errorf("pg connerct err: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	res := conn.ExecParams(ctx, `
+		SELECT n.nspname, c.relname
+		FROM pg_catalog.pg_publication_rel pr
+		JOIN pg_catalog.pg_publication p ON p.oid = pr.prpubid
+		JOIN pg_catalog.pg_class c ON c.oid = pr.prrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE p.pubname = $1;
+		`, [][]byte{[]byte(publication())}, nil, nil, nil).Read()
+	if res.Err != nil {
+		return fmt.Errorf("pg get pg_publication_rel err: %v", res.Err)
+	}
+	for _, row := range res.Rows {
+		rel := pgRelation{string(row[0]), string(row[1])}
+		mx.Lock()
+		opt := cachedTable(rel.shema, rel.table)
+		mx.Unlock()
+		if opt != nil && !opt.refreshMode() {
+			continue
+		}
+		glog.Noticef("table %s.%s is not streamed, removing it from publication %s", rel.shema, rel.table, publication())
+		_, err = conn.Exec(ctx, fmt.Sprintf("ALTER PUBLICATION %s DROP TABLE %s;",
+			quoteIdent(publication()),
+			quoteTable(rel.shema, rel.table),
+		)).ReadAll()
+		if err != nil {
+			return fmt.Errorf("alter publication err: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package replica
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// states of copyDecoder
+const (
+	copyHeader = iota
+	copyExtension
+	copyTuple
+	copyFieldLen
+	copyField
+	copyDone
+)
+
+// copyHasOIDs - header flag of the COPY WITH OIDS format of old servers
+const copyHasOIDs = 1 << 16
+
+// copyDecoder - reads a COPY BINARY stream written in chunks of any size.
+// A tuple may be split across writes and a write may hold several tuples,
+// row is called for every decoded tuple and must not keep the values after it returns.
+type copyDecoder struct {
+	oids []uint32
+	row  func(vals []driver.Value) error
+
+	state int
+	buf   []byte
+	pos   int
+	// off - stream offset of buf[0]
+	off int64
+	// need - length of the extension or the field being read
+	need int
+	vals []driver.Value
+	col  int
+	rows int64
+}
+
+func newCopyDecoder(fields []pgconn.FieldDescription, row func(vals []driver.Value) error) *copyDecoder {
+	d := &copyDecoder{row: row, oids: make([]uint32, len(fields))}
+	for i, f := range fields {
+		d.oids[i] = f.DataTypeOID
+	}
+	return d
+}
+
+// Write - io.Writer
+func (d *copyDecoder) Write(src []byte) (int, error) {
+	if d.pos > 0 {
+		// drop the consumed bytes
+		d.off += int64(d.pos)
+		d.buf = d.buf[:copy(d.buf, d.buf[d.pos:])]
+		d.pos = 0
+	}
+	d.buf = append(d.buf, src...)
+	for {
+		ok, err := d.step()
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return len(src), nil
+		}
+	}
+}
+
+// Close - checks that the stream ended with the trailer
+func (d *copyDecoder) Close() error {
+	switch {
+	case d.state == copyDone:
+		return nil
+	case d.state == copyTuple && d.pos == len(d.buf):
+		return d.errorf("missing trailer after %d rows", d.rows)
+	}
+	return d.errorf("stream ends inside %s", d.stateName())
+}
+
+// step - advances the state if the buffer holds enough bytes
+func (d *copyDecoder) step() (bool, error) {
+	switch d.state {
+	case copyHeader:
+		if !d.has(len(signature) + 8) {
+			return false, nil
+		}
+		if !bytes.Equal(d.buf[d.pos:d.pos+len(signature)], signature) {
+			return false, d.errorf("invalid file signature")
+		}
+		d.pos += len(signature)
+		flags := d.int32()
+		if flags&copyHasOIDs != 0 {
+			return false, d.errorf("rows with oids are not supported")
+		}
+		d.need = int(d.int32())
+		if d.need < 0 {
+			return false, d.errorf("invalid header extension length %d", d.need)
+		}
+		d.state = copyExtension
+
+	case copyExtension:
+		if !d.has(d.need) {
+			return false, nil
+		}
+		d.pos += d.need
+		d.state = copyTuple
+
+	case copyTuple:
+		if !d.has(2) {
+			return false, nil
+		}
+		n := int(int16(binary.BigEndian.Uint16(d.buf[d.pos:])))
+		if n == -1 {
+			d.pos += 2
+			d.state = copyDone
+			return true, nil
+		}
+		if n != len(d.oids) {
+			return false, d.errorf("tuple has %d fields, %d expected", n, len(d.oids))
+		}
+		d.pos += 2
+		d.vals = make([]driver.Value, n)
+		d.col = 0
+		d.state = copyFieldLen
+		if n == 0 {
+			return true, d.emit()
+		}
+
+	case copyFieldLen:
+		if !d.has(4) {
+			return false, nil
+		}
+		n := int(d.peekInt32())
+		if n < -1 {
+			return false, d.errorf("invalid length %d of field %d", n, d.col)
+		}
+		d.pos += 4
+		if n == -1 {
+			d.vals[d.col] = nil
+			return true, d.next()
+		}
+		d.need = n
+		d.state = copyField
+
+	case copyField:
+		if !d.has(d.need) {
+			return false, nil
+		}
+		v, err := decodeColumn(pgtype.BinaryFormatCode, d.oids[d.col], d.buf[d.pos:d.pos+d.need])
+		if err != nil {
+			return false, d.errorf("field %d: %v", d.col, err)
+		}
+		d.vals[d.col] = v
+		d.pos += d.need
+		return true, d.next()
+
+	case copyDone:
+		if d.pos < len(d.buf) {
+			return false, d.errorf("%d bytes after the trailer", len(d.buf)-d.pos)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// next - moves to the next field, emits the row after the last one
+func (d *copyDecoder) next() error {
+	d.col++
+	d.state = copyFieldLen
+	if d.col < len(d.vals) {
+		return nil
+	}
+	return d.emit()
+}
+
+func (d *copyDecoder) emit() error {
+	d.state = copyTuple
+	d.rows++
+	err := d.row(d.vals)
+	if err != nil {
+		return fmt.Errorf("copy row %d: %v", d.rows, err)
+	}
+	return nil
+}
+
+func (d *copyDecoder) has(n int) bool {
+	return len(d.buf)-d.pos >= n
+}
+
+func (d *copyDecoder) peekInt32() int32 {
+	return int32(binary.BigEndian.Uint32(d.buf[d.pos:]))
+}
+
+func (d *copyDecoder) int32() int32 {
+	v := d.peekInt32()
+	d.pos += 4
+	return v
+}
+
+func (d *copyDecoder) stateName() string {
+	switch d.state {
+	case copyHeader, copyExtension:
+		return "the header"
+	case copyTuple:
+		return "a tuple header"
+	}
+	return fmt.Sprintf("field %d of row %d", d.col, d.rows+1)
+}
+
+// errorf - protocol error at the current stream offset
+func (d *copyDecoder) errorf(format string, args ...any) error {
+	return fmt.Errorf("copy binary at offset %d: %s", d.off+int64(d.pos), fmt.Sprintf(format, args...))
+}
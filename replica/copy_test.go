@@ -0,0 +1,171 @@
+package replica
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// copyStream - COPY BINARY of (id int8, name text, ok bool) rows, a nil value is NULL
+type copyStream struct {
+	bytes.Buffer
+}
+
+func newCopyStream(flags uint32, ext []byte) *copyStream {
+	s := new(copyStream)
+	s.Write(signature)
+	binary.Write(s, binary.BigEndian, flags)
+	binary.Write(s, binary.BigEndian, uint32(len(ext)))
+	s.Write(ext)
+	return s
+}
+
+func (s *copyStream) row(vals ...[]byte) {
+	binary.Write(s, binary.BigEndian, int16(len(vals)))
+	for _, v := range vals {
+		if v == nil {
+			binary.Write(s, binary.BigEndian, int32(-1))
+			continue
+		}
+		binary.Write(s, binary.BigEndian, int32(len(v)))
+		s.Write(v)
+	}
+}
+
+func (s *copyStream) trailer() {
+	binary.Write(s, binary.BigEndian, int16(-1))
+}
+
+func int8Bytes(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+var copyFields = []pgconn.FieldDescription{
+	{Name: "id", DataTypeOID: 20},
+	{Name: "name", DataTypeOID: 25},
+	{Name: "ok", DataTypeOID: 16},
+}
+
+func validCopyStream() ([]byte, [][]driver.Value) {
+	s := newCopyStream(0, []byte{1, 2, 3})
+	s.row(int8Bytes(1), []byte("alice"), []byte{1})
+	s.row(int8Bytes(-2), []byte(""), nil)
+	s.row(int8Bytes(1<<40), nil, []byte{0})
+	s.row(int8Bytes(4), []byte(strings.Repeat("x", 300)), []byte{1})
+	s.trailer()
+	return s.Bytes(), [][]driver.Value{
+		{int64(1), "alice", true},
+		{int64(-2), "", nil},
+		{int64(1 << 40), nil, false},
+		{int64(4), strings.Repeat("x", 300), true},
+	}
+}
+
+// decodeCopy - writes the chunks to a new decoder and closes it
+func decodeCopy(chunks ...[]byte) ([][]driver.Value, error) {
+	var rows [][]driver.Value
+	d := newCopyDecoder(copyFields, func(vals []driver.Value) error {
+		rows = append(rows, append([]driver.Value(nil), vals...))
+		return nil
+	})
+	for _, c := range chunks {
+		n, err := d.Write(c)
+		if err != nil {
+			return rows, err
+		}
+		if n != len(c) {
+			return rows, io.ErrShortWrite
+		}
+	}
+	return rows, d.Close()
+}
+
+func TestCopyDecoderSplits(t *testing.T) {
+	stream, want := validCopyStream()
+	for i := 0; i <= len(stream); i++ {
+		rows, err := decodeCopy(stream[:i], stream[i:])
+		if err != nil {
+			t.Fatalf("split at %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(rows, want) {
+			t.Fatalf("split at %d: rows %v, want %v", i, rows, want)
+		}
+	}
+	for _, size := range []int{1, 2, 3, 7} {
+		var chunks [][]byte
+		for rest := stream; len(rest) > 0; {
+			n := size
+			if n > len(rest) {
+				n = len(rest)
+			}
+			chunks = append(chunks, rest[:n])
+			rest = rest[n:]
+		}
+		rows, err := decodeCopy(chunks...)
+		if err != nil {
+			t.Fatalf("chunks of %d: %v", size, err)
+		}
+		if !reflect.DeepEqual(rows, want) {
+			t.Fatalf("chunks of %d: rows %v, want %v", size, rows, want)
+		}
+	}
+}
+
+func TestCopyDecoderErrors(t *testing.T) {
+	stream, _ := validCopyStream()
+
+	badSignature := append([]byte(nil), stream...)
+	badSignature[0] = 'X'
+
+	oids := newCopyStream(copyHasOIDs, nil)
+	oids.trailer()
+
+	fields := newCopyStream(0, nil)
+	fields.row(int8Bytes(1), []byte("a"))
+	fields.trailer()
+
+	badLen := newCopyStream(0, nil)
+	binary.Write(badLen, binary.BigEndian, int16(3))
+	binary.Write(badLen, binary.BigEndian, int32(-5))
+
+	noTrailer := newCopyStream(0, nil)
+	noTrailer.row(int8Bytes(1), []byte("a"), []byte{1})
+
+	for _, tc := range []struct {
+		name   string
+		stream []byte
+		err    string
+	}{
+		{"bad signature", badSignature, "invalid file signature"},
+		{"oids", oids.Bytes(), "rows with oids are not supported"},
+		{"field count", fields.Bytes(), "tuple has 2 fields, 3 expected"},
+		{"field length", badLen.Bytes(), "invalid length -5 of field 0"},
+		{"short header", stream[:len(signature)+3], "stream ends inside the header"},
+		{"short trailer", stream[:len(stream)-1], "stream ends inside a tuple header"},
+		{"short field", stream[:len(stream)-4], "stream ends inside field 2 of row 4"},
+		{"missing trailer", noTrailer.Bytes(), "missing trailer after 1 rows"},
+		{"bytes after trailer", append(append([]byte(nil), stream...), 0, 1), "2 bytes after the trailer"},
+		{"empty", nil, "stream ends inside the header"},
+	} {
+		_, err := decodeCopy(tc.stream)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: error %v, want %q", tc.name, err, tc.err)
+		}
+	}
+
+	// the error has the stream offset, also when it is found in a later write
+	_, err := decodeCopy(stream[:10], stream[10:], []byte{7})
+	want := "offset " + strconv.Itoa(len(stream))
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("trailing byte: error %v, want %q", err, want)
+	}
+}
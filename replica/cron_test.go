@@ -0,0 +1,101 @@
+package replica
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, tc := range []struct {
+		spec string
+		from string
+		want string // empty - no time within 5 years
+	}{
+		// the next time is strictly after from
+		{"0 * * * *", "2025-01-01 10:00", "2025-01-01 11:00"},
+		{"* * * * *", "2025-01-01 10:00", "2025-01-01 10:01"},
+		// steps
+		{"*/15 * * * *", "2025-01-01 10:07", "2025-01-01 10:15"},
+		{"*/15 * * * *", "2025-01-01 10:45", "2025-01-01 11:00"},
+		{"0 */6 * * *", "2025-01-01 13:00", "2025-01-01 18:00"},
+		// a/n runs from a to the end of the range
+		{"5/20 * * * *", "2025-01-01 10:26", "2025-01-01 10:45"},
+		{"5/20 * * * *", "2025-01-01 10:45", "2025-01-01 11:05"},
+		// lists of values and stepped ranges
+		{"0,30 9-17/4 * * *", "2025-01-01 13:31", "2025-01-01 17:00"},
+		{"0,30 9-17/4 * * *", "2025-01-01 17:30", "2025-01-02 09:00"},
+		{"10,20-22 * * * *", "2025-01-01 10:20", "2025-01-01 10:21"},
+		// 7 is sunday like 0, 2025-01-01 is a wednesday
+		{"0 0 * * 7", "2025-01-01 00:00", "2025-01-05 00:00"},
+		{"0 0 * * 0", "2025-01-01 00:00", "2025-01-05 00:00"},
+		{"0 0 * * 5-7", "2025-01-04 12:00", "2025-01-05 00:00"},
+		// restricted day of month and day of week match either of them
+		{"0 0 13 * 5", "2025-01-01 00:00", "2025-01-03 00:00"},
+		{"0 0 13 * 5", "2025-01-11 00:00", "2025-01-13 00:00"},
+		// only one restricted day field must match
+		{"0 0 13 * *", "2025-01-01 00:00", "2025-01-13 00:00"},
+		{"0 0 * * 1", "2025-01-01 00:00", "2025-01-06 00:00"},
+		// rollover to the next month and year
+		{"0 0 1 * *", "2025-01-31 23:59", "2025-02-01 00:00"},
+		{"0 0 31 * *", "2025-01-31 00:00", "2025-03-31 00:00"},
+		{"0 0 1 1 *", "2025-06-15 08:00", "2026-01-01 00:00"},
+		{"30 23 31 12 *", "2025-12-31 23:30", "2026-12-31 23:30"},
+		{"0 0 29 2 *", "2025-01-01 00:00", "2028-02-29 00:00"},
+		// macros
+		{"@hourly", "2025-01-01 10:15", "2025-01-01 11:00"},
+		{"@daily", "2025-01-01 10:15", "2025-01-02 00:00"},
+		{"@weekly", "2025-01-01 10:15", "2025-01-05 00:00"},
+		{"@monthly", "2025-01-01 10:15", "2025-02-01 00:00"},
+		// no matching day within 5 years
+		{"0 0 30 2 *", "2025-01-01 00:00", ""},
+		{"0 0 31 4 *", "2025-01-01 00:00", ""},
+	} {
+		c, err := parseCron(tc.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tc.spec, err)
+			continue
+		}
+		got := c.next(at(tc.from))
+		if tc.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q after %s = %s, want none", tc.spec, tc.from, got.Format("2006-01-02 15:04"))
+			}
+			continue
+		}
+		if !got.Equal(at(tc.want)) {
+			t.Errorf("%q after %s = %s, want %s", tc.spec, tc.from, got.Format("2006-01-02 15:04"), tc.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@yearly",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		"1,,2 * * * *",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q): error expected", spec)
+		}
+	}
+}
@@ -7,225 +7,418 @@ import (
 
 	"github.com/bendersilver/glog"
 	"github.com/bendersilver/pgcache/sqlite"
-	"github.com/jackc/pglogrepl"
-	"github.com/jackc/pgx/v5/pgproto3"
-	"github.com/jackc/pgx/v5/pgtype"
 )
 
-func (r *replication) handle(m *pgproto3.CopyData) error {
+// event - applies a source event
+func (r *replication) event(ev *Event) error {
+	if ev.Kind == EventKeepalive {
+		r.keepalive(ev.LSN)
+		return nil
+	}
 	mx.Lock()
 	defer mx.Unlock()
+	if ev.LSN != 0 {
+		r.received = ev.LSN
+	}
+
+	switch ev.Kind {
+	case EventRelation:
+		id := ev.Relation.ID
+		if old, ok := r.relations[id]; ok {
+			// the held update may use the statements of the old item
+			r.release()
+			old.close()
+		}
+		ri, err := newRrelationItem(ev.Relation)
+		if err != nil {
+			// changes of the relation are skipped until it is added again
+			r.relations[id] = &relationItem{rel: ev.Relation}
+			return err
+		}
+		r.relations[id] = ri
+
+	case EventInsert, EventUpdate, EventDelete:
+		r.logLoad(ev.RelationID, ev)
+		r.apply(ev.RelationID, ev)
 
-	xld, err := pglogrepl.ParseXLogData(m.Data[1:])
+	case EventTruncate:
+		for _, relID := range ev.RelationIDs {
+			r.logLoad(relID, ev)
+		}
+		r.truncate(ev)
+
+	case EventBegin:
+		r.inTx = true
+	case EventCommit:
+		r.inTx = false
+		r.commit(ev.LSN)
+	}
+	return nil
+}
+
+// apply - writes the change to sqlite and keeps it for a running resync of the table
+func (r *replication) apply(relID uint32, ev *Event) {
+	rel, ok := r.relations[relID]
+	if !ok {
+		glog.Errorf("%s relation %d not found", ev.Kind, relID)
+		return
+	}
+	if rel.skipped() {
+		return
+	}
+	c, err := rel.decode(ev)
 	if err != nil {
 		glog.Error(err)
-		return err
+		return
+	}
+	if c == nil {
+		return
+	}
+	r.write(rel, c)
+	if cl, ok := resyncs[rel.tableName]; ok {
+		cl.add(rel.rel, ev)
+	}
+}
+
+// truncate - empties the cached relations of the statement together, either all or none of them.
+// Relations that are not cached or ignore truncates are left alone without logging.
+func (r *replication) truncate(ev *Event) {
+	var list []*relationItem
+	var names []string
+	for _, relID := range ev.RelationIDs {
+		rel, ok := r.relations[relID]
+		if !ok || rel.skipped() || rel.opt != nil && rel.opt.IgnoreTruncate {
+			continue
+		}
+		list = append(list, rel)
+		names = append(names, rel.tableName)
+	}
+	if len(list) == 0 {
+		return
 	}
-	r.lsn = xld.WALStart + pglogrepl.LSN(len(xld.WALData))
+	var opts string
+	if ev.Cascade {
+		opts += " cascade"
+	}
+	if ev.RestartIdentity {
+		// sqlite tables have no sequences to restart
+		opts += " restart identity"
+	}
+	glog.Noticef("truncate%s %s", opts, strings.Join(names, ", "))
 
-	msg, err := pglogrepl.Parse(xld.WALData)
+	r.release()
+	r.begin()
+	err := db.Exec("SAVEPOINT truncate;")
 	if err != nil {
 		glog.Error(err)
-		return err
+		return
 	}
-
-	switch msg := msg.(type) {
-	case *pglogrepl.RelationMessage:
-		r.relations[msg.RelationID], err = newRrelationItem(msg)
+	c := &change{kind: EventTruncate}
+	for _, rel := range list {
+		err = rel.exec(c)
 		if err != nil {
-			return err
+			break
 		}
-
-	case *pglogrepl.InsertMessage:
-		rel, ok := r.relations[msg.RelationID]
-		if !ok {
-			glog.Error("pglogrepl.InsertMessage.id %d not found", msg.RelationID)
-		} else {
-			err = rel.insertMsg(msg)
-			if err != nil {
-				glog.Error(err)
-			}
+	}
+	if err != nil {
+		glog.Errorf("truncate %s err: %v", strings.Join(names, ", "), err)
+		db.Exec("ROLLBACK TO truncate;")
+		db.Exec("RELEASE truncate;")
+		return
+	}
+	err = db.Exec("RELEASE truncate;")
+	if err != nil {
+		glog.Error(err)
+		return
+	}
+	r.written()
+	for _, rel := range list {
+		if cl, ok := resyncs[rel.tableName]; ok {
+			cl.add(rel.rel, &Event{Kind: EventTruncate, LSN: ev.LSN})
 		}
+	}
+}
 
-	case *pglogrepl.UpdateMessage:
-		rel, ok := r.relations[msg.RelationID]
-		if !ok {
-			glog.Error("pglogrepl.UpdateMessage.id %d not found", msg.RelationID)
-		} else {
-			err = rel.updateMsg(msg)
-			if err != nil {
-				glog.Error(err)
-			}
-		}
+// change - decoded row change
+type change struct {
+	kind EventKind
+	row  []driver.Value
+	key  driver.Value
+}
+
+type relationItem struct {
+	rel       *Relation
+	tableName string
+	pkIx      int
+	// cols - indexes of the stored relation columns
+	cols []int
+	// names - names of the stored columns, pkPos - position of the key among them
+	names    []string
+	pkPos    int
+	opt      *AddOptions
+	insert   *sqlite.Stmt
+	update   *sqlite.Stmt
+	delete   *sqlite.Stmt
+	truncate *sqlite.Stmt
+}
 
-	case *pglogrepl.DeleteMessage:
-		rel, ok := r.relations[msg.RelationID]
-		if !ok {
-			glog.Error("pglogrepl.DeleteMessage.id %d not found", msg.RelationID)
-		} else {
-			err = rel.deleteMsg(msg)
+func newRrelationItem(m *Relation) (ri *relationItem, err error) {
+	if opt := cachedTable(m.Namespace, m.Name); opt != nil {
+		if opt.refreshMode() {
+			return &relationItem{rel: m}, nil
+		}
+		if createTables {
+			err = createSourceTable(m, opt, opt.tableName())
 			if err != nil {
-				glog.Error(err)
+				return nil, err
 			}
 		}
+		return newTableItem(m, opt.tableName(), opt)
+	}
+	if !managedPublication() || loading(m.Namespace, m.Name) {
+		// the publication or wal2json may send more tables than are cached,
+		// changes of a table in a chunked load are kept by logLoad
+		return &relationItem{rel: m}, nil
+	}
+	target, err := targetName("main", m.Namespace+"_"+m.Name)
+	if err != nil {
+		return nil, err
+	}
+	if createTables {
+		err = createSourceTable(m, nil, target)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newTableItem(m, target, nil)
+}
 
-	case *pglogrepl.TruncateMessage:
-		for _, relID := range msg.RelationIDs {
-			rel, ok := r.relations[relID]
-			if !ok {
-				glog.Error("pglogrepl.TruncateMessage.id %d not found", relID)
-			} else {
-				err = rel.deleteAll()
-				if err != nil {
-					glog.Error(err)
-				}
+// retarget - points the relations already received for the table to its sqlite name and options, mx must be held
+func (r *replication) retarget(opt *AddOptions) {
+	r.flush()
+	for id, ri := range r.relations {
+		if !opt.matches(ri.rel.Namespace, ri.rel.Name) || ri.opt == opt {
+			continue
+		}
+		if opt.refreshMode() {
+			if !ri.skipped() {
+				ri.close()
+				r.relations[id] = &relationItem{rel: ri.rel}
 			}
+			continue
+		}
+		item, err := newTableItem(ri.rel, opt.tableName(), opt)
+		if err != nil {
+			glog.Error(err)
+			continue
 		}
+		ri.close()
+		r.relations[id] = item
+	}
+}
 
-	case *pglogrepl.BeginMessage:
-	case *pglogrepl.CommitMessage:
-	case *pglogrepl.TypeMessage:
-	case *pglogrepl.OriginMessage:
+// untarget - stops writing the relations of the dropped table, mx must be held
+func (r *replication) untarget(opt *AddOptions) {
+	r.flush()
+	for id, ri := range r.relations {
+		if ri.opt != opt {
+			continue
+		}
+		ri.close()
+		r.relations[id] = &relationItem{rel: ri.rel}
 	}
-	return nil
 }
 
-type relationItem struct {
-	msg       *pglogrepl.RelationMessage
-	tableName string
-	pkIx      int
-	insert    *sqlite.Stmt
-	update    *sqlite.Stmt
-	delete    *sqlite.Stmt
-	truncate  *sqlite.Stmt
+// skipped - changes of the relation are not cached
+func (ri *relationItem) skipped() bool {
+	return ri.truncate == nil
 }
 
-func newRrelationItem(m *pglogrepl.RelationMessage) (ri *relationItem, err error) {
+// newTableItem - relation written to the sqlite table tableName,
+// stored columns and transformations are taken from opt if it is not nil
+func newTableItem(m *Relation, tableName string, opt *AddOptions) (ri *relationItem, err error) {
 	ri = new(relationItem)
-	ri.msg = m
-	ri.tableName = fmt.Sprintf("%s_%s", m.Namespace, m.RelationName)
-	names := make([]string, len(m.Columns))
-	params := make([]string, len(m.Columns))
+	ri.rel = m
+	ri.tableName = tableName
+	ri.opt = opt
+	var columns []string
+	if opt != nil {
+		columns = opt.Columns
+	}
 	for i, c := range m.Columns {
-		if c.Flags == 1 {
+		if c.Key {
 			ri.pkIx = i
 		}
-		names[i] = c.Name
-		params[i] = "?"
+		if len(columns) > 0 && !contains(columns, c.Name) {
+			continue
+		}
+		if i == ri.pkIx {
+			ri.pkPos = len(ri.cols)
+		}
+		ri.cols = append(ri.cols, i)
+		ri.names = append(ri.names, c.Name)
 	}
-	sql := fmt.Sprintf("INSERT OR IGNORE INTO %s(%s) VALUES (%s);",
-		ri.tableName,
-		strings.Join(names, " ,"),
-		strings.Join(params, " ,"),
-	)
-	ri.insert, err = db.Prepare(sql)
+	table := quoteTarget(tableName)
+	ri.truncate, err = db.Prepare(fmt.Sprintf("DELETE FROM %s;", table))
 	if err != nil {
 		glog.Error(err)
 		return
 	}
-
-	sql = fmt.Sprintf("DELETE FROM %s WHERE %s = ?;",
-		ri.tableName,
-		m.Columns[ri.pkIx].Name,
-	)
-	ri.delete, err = db.Prepare(sql)
+	if len(m.Columns) == 0 {
+		// only the name is known, the relation can be truncated
+		return ri, nil
+	}
+	key := m.Columns[ri.pkIx].Name
+	if len(columns) > 0 && !contains(columns, key) {
+		ri.close()
+		return nil, fmt.Errorf("key column %s of %s is not cached", key, tableName)
+	}
+	ri.insert, err = db.Prepare(opt.insertSQL("INSERT OR IGNORE", tableName, ri.names))
 	if err != nil {
 		glog.Error(err)
 		return
 	}
 
-	ri.truncate, err = db.Prepare(fmt.Sprintf("DELETE FROM %s;", ri.tableName))
+	sql := fmt.Sprintf("DELETE FROM %s WHERE %s = %s;",
+		table,
+		quoteIdent(key),
+		opt.keyParam(key),
+	)
+	ri.delete, err = db.Prepare(sql)
 	if err != nil {
 		glog.Error(err)
 		return
 	}
 
-	for i, v := range names {
-		params[i] = v + " = ?"
-	}
-	sql = fmt.Sprintf("UPDATE %s SET %s WHERE %s = ?;",
-		ri.tableName,
-		strings.Join(params, " ,"),
-		m.Columns[ri.pkIx].Name,
-	)
-	ri.update, err = db.Prepare(sql)
+	ri.update, err = db.Prepare(opt.updateSQL(tableName, ri.names, key))
 	return
 }
 
-func (ri *relationItem) updateMsg(msg *pglogrepl.UpdateMessage) error {
-	var pk driver.Value
-	if msg.OldTuple != nil {
-		tuple, err := ri.decodeTuple(msg.OldTuple)
+func (ri *relationItem) close() {
+	for _, s := range []*sqlite.Stmt{ri.insert, ri.update, ri.delete, ri.truncate} {
+		if s != nil {
+			s.Close()
+		}
+	}
+}
+
+// decode - nil change means nothing to apply
+func (ri *relationItem) decode(ev *Event) (*change, error) {
+	switch ev.Kind {
+	case EventInsert:
+		if ev.New == nil {
+			return nil, nil
+		}
+		row, err := ri.row(ev.New)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		for i, c := range ri.msg.Columns {
-			if c.Flags == 1 {
-				pk = tuple[i]
-				break
+		return &change{kind: EventInsert, row: row}, nil
+
+	case EventUpdate:
+		var pk driver.Value
+		if ev.Old != nil {
+			old, err := ri.row(ev.Old)
+			if err != nil {
+				return nil, err
 			}
+			pk = old[ri.pkPos]
 		}
-	}
-	if msg.NewTuple != nil {
-		tuple, err := ri.decodeTuple(msg.NewTuple)
+		if ev.New == nil {
+			return nil, nil
+		}
+		row, err := ri.row(ev.New)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if pk == nil {
-			pk = tuple[ri.pkIx]
+			pk = row[ri.pkPos]
+		}
+		return &change{kind: EventUpdate, row: row, key: pk}, nil
+
+	case EventDelete:
+		if ev.Old == nil {
+			return nil, nil
 		}
-		tuple = append(tuple, pk)
-		return ri.update.Exec(tuple...)
+		old, err := ri.row(ev.Old)
+		if err != nil {
+			return nil, err
+		}
+		return &change{kind: EventDelete, key: old[ri.pkPos]}, nil
+
+	case EventTruncate:
+		return &change{kind: EventTruncate}, nil
 	}
+	return nil, nil
+}
 
-	return nil
+// row - transformed values of the stored columns of the tuple
+func (ri *relationItem) row(tuple []driver.Value) ([]driver.Value, error) {
+	if len(tuple) != len(ri.rel.Columns) {
+		return nil, fmt.Errorf("%s.%s: %d values, %d columns", ri.rel.Namespace, ri.rel.Name, len(tuple), len(ri.rel.Columns))
+	}
+	row := ri.project(tuple)
+	err := ri.opt.transform(ri.names, row)
+	if err != nil {
+		return nil, err
+	}
+	return row, nil
 }
 
-func (ri *relationItem) deleteAll() error {
-	return ri.truncate.Exec()
+// project - values of the stored columns
+func (ri *relationItem) project(tuple []driver.Value) []driver.Value {
+	if len(ri.cols) == len(tuple) {
+		return tuple
+	}
+	row := make([]driver.Value, len(ri.cols))
+	for i, ix := range ri.cols {
+		row[i] = tuple[ix]
+	}
+	return row
 }
 
-func (ri *relationItem) deleteMsg(msg *pglogrepl.DeleteMessage) error {
-	if msg.OldTuple != nil {
-		tuple, err := ri.decodeTuple(msg.OldTuple)
-		if err != nil {
-			return err
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
 		}
-		return ri.delete.Exec(tuple[ri.pkIx])
 	}
-
-	return nil
+	return false
 }
 
-func (ri *relationItem) insertMsg(msg *pglogrepl.InsertMessage) error {
-	if msg.Tuple != nil {
-
-		tuple, err := ri.decodeTuple(msg.Tuple)
+// set - applies the change as the last state of its keys, for changes that may be
+// older than the rows: inserts and updates replace the rows of the old and the new key
+func (ri *relationItem) set(c *change) error {
+	var keys []driver.Value
+	switch c.kind {
+	case EventInsert:
+		keys = []driver.Value{c.row[ri.pkPos]}
+	case EventUpdate:
+		keys = []driver.Value{c.key, c.row[ri.pkPos]}
+	default:
+		return ri.exec(c)
+	}
+	for _, k := range keys {
+		err := ri.delete.Exec(k)
 		if err != nil {
 			return err
 		}
-		return ri.insert.Exec(tuple...)
 	}
-	return nil
+	return ri.insert.Exec(c.row...)
 }
 
-func (ri *relationItem) decodeTuple(tuple *pglogrepl.TupleData) (vals []driver.Value, err error) {
-	cols := ri.msg.Columns
-	vals = make([]driver.Value, len(cols))
-	for ix, col := range tuple.Columns {
-		rc := cols[ix]
-		switch col.DataType {
-		case 'n':
-			vals[ix] = nil
-		case 'u': // unchanged toast
-			// This TOAST value was not changed. TOAST values are not stored in the tuple, and logical replication doesn't want to spend a disk read to fetch its value for you.
-		case 't': //text
-			vals[ix], err = decodeColumn(pgtype.TextFormatCode, rc.DataType, col.Data)
-			if err != nil {
-				glog.Error(err)
-				return nil, err
-			}
-		}
+func (ri *relationItem) exec(c *change) error {
+	switch c.kind {
+	case EventInsert:
+		return ri.insert.Exec(c.row...)
+	case EventUpdate:
+		args := make([]driver.Value, 0, len(c.row)+1)
+		args = append(args, c.row...)
+		return ri.update.Exec(append(args, c.key)...)
+	case EventDelete:
+		return ri.delete.Exec(c.key)
+	case EventTruncate:
+		return ri.truncate.Exec()
 	}
-	return
+	return nil
 }
@@ -0,0 +1,109 @@
+package replica
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// namedRelation - relation (id int8 key, name text, qty int8) of the namespace named name
+func namedRelation(id uint32, namespace, name string) *Event {
+	ev := itemsRelation(id, namespace)
+	ev.Relation.Name = name
+	return ev
+}
+
+// truncateSetup - relations a (1) and b (2) of a new namespace with two rows each
+func truncateSetup(t *testing.T, cfg func(ns string) *Config, tail ...*Event) (string, []*Event) {
+	t.Helper()
+	sourceRuns++
+	ns := fmt.Sprintf("run%d", sourceRuns)
+	base := pglogrepl.LSN(1000 * sourceRuns)
+	events := []*Event{namedRelation(1, ns, "a"), namedRelation(2, ns, "b")}
+	events = append(events, txEvents(base+10,
+		insertEvent(1, int64(1), "a1", int64(1)),
+		insertEvent(1, int64(2), "a2", int64(2)),
+		insertEvent(2, int64(1), "b1", int64(1)),
+		insertEvent(2, int64(2), "b2", int64(2)),
+	)...)
+	events = append(events, txEvents(base+20, tail...)...)
+	var c *Config
+	if cfg != nil {
+		c = cfg(ns)
+	}
+	runEvents(t, c, events...)
+	return ns, events
+}
+
+func TestTruncate(t *testing.T) {
+	both := []string{"1 a1 1", "2 a2 2"}
+	bRows := []string{"1 b1 1", "2 b2 2"}
+
+	t.Run("statement", func(t *testing.T) {
+		ns, _ := truncateSetup(t, nil,
+			&Event{Kind: EventTruncate, RelationIDs: []uint32{1, 2}},
+			insertEvent(2, int64(3), "b3", int64(3)),
+		)
+		if rows := cachedRows(t, ns+"_a"); len(rows) != 0 {
+			t.Errorf("a rows %q, want none", rows)
+		}
+		if rows, want := cachedRows(t, ns+"_b"), []string{"3 b3 3"}; !reflect.DeepEqual(rows, want) {
+			t.Errorf("b rows %q, want %q", rows, want)
+		}
+	})
+
+	t.Run("ignore truncate", func(t *testing.T) {
+		ns, _ := truncateSetup(t, func(ns string) *Config {
+			return &Config{Tables: []TableConfig{{Name: ns + ".b", IgnoreTruncate: true}}}
+		},
+			&Event{Kind: EventTruncate, RelationIDs: []uint32{1, 2}, Cascade: true},
+		)
+		if rows := cachedRows(t, ns+"_a"); len(rows) != 0 {
+			t.Errorf("a rows %q, want none", rows)
+		}
+		if rows := cachedRows(t, ns+"_b"); !reflect.DeepEqual(rows, bRows) {
+			t.Errorf("b rows %q, want %q", rows, bRows)
+		}
+	})
+
+	t.Run("unknown relations", func(t *testing.T) {
+		// relation 9 was never sent
+		ns, events := truncateSetup(t, nil,
+			&Event{Kind: EventTruncate, RelationIDs: []uint32{9, 2}},
+		)
+		if rows := cachedRows(t, ns+"_a"); !reflect.DeepEqual(rows, both) {
+			t.Errorf("a rows %q, want %q", rows, both)
+		}
+		if rows := cachedRows(t, ns+"_b"); len(rows) != 0 {
+			t.Errorf("b rows %q, want none", rows)
+		}
+		last := events[len(events)-1].LSN
+		if got := r.applied.get(); got != last {
+			t.Errorf("applied %s, want %s", got, last)
+		}
+	})
+
+	t.Run("all or none", func(t *testing.T) {
+		ns, _ := truncateSetup(t, nil)
+		// the rows of b can't be deleted, a keeps its rows too
+		err := db.Exec(fmt.Sprintf("CREATE TRIGGER %s BEFORE DELETE ON %s BEGIN SELECT RAISE(ABORT, 'locked'); END;",
+			quoteIdent(ns+"_b_locked"), quoteIdent(ns+"_b")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := pglogrepl.LSN(1000*sourceRuns) + 100
+		runEvents(t, nil, append([]*Event{namedRelation(1, ns, "a"), namedRelation(2, ns, "b")},
+			txEvents(base,
+				&Event{Kind: EventTruncate, RelationIDs: []uint32{1, 2}},
+				insertEvent(1, int64(3), "a3", int64(3)),
+			)...)...)
+		if rows, want := cachedRows(t, ns+"_a"), append(both, "3 a3 3"); !reflect.DeepEqual(rows, want) {
+			t.Errorf("a rows %q, want %q", rows, want)
+		}
+		if rows := cachedRows(t, ns+"_b"); !reflect.DeepEqual(rows, bRows) {
+			t.Errorf("b rows %q, want %q", rows, bRows)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package replica
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// ErrWaitTimeout - returned by WaitLSN when the applied LSN did not reach the target in time
+var ErrWaitTimeout = errors.New("wait lsn timeout")
+
+// ErrNoLSN - returned by WaitLSN in trigger capture mode, positions are changelog ids there
+var ErrNoLSN = errors.New("wait lsn is not supported in trigger capture mode")
+
+// lsnWaiter - applied position with wake-up of the waiting readers
+type lsnWaiter struct {
+	sync.Mutex
+	lsn pglogrepl.LSN
+	ch  chan struct{}
+}
+
+func (w *lsnWaiter) get() pglogrepl.LSN {
+	w.Lock()
+	defer w.Unlock()
+	return w.lsn
+}
+
+// advance - moves the position forward and wakes up the waiters
+func (w *lsnWaiter) advance(lsn pglogrepl.LSN) {
+	w.Lock()
+	defer w.Unlock()
+	if lsn <= w.lsn {
+		return
+	}
+	w.lsn = lsn
+	if w.ch != nil {
+		close(w.ch)
+		w.ch = nil
+	}
+}
+
+func (w *lsnWaiter) wait(lsn pglogrepl.LSN, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		w.Lock()
+		if w.lsn >= lsn {
+			w.Unlock()
+			return nil
+		}
+		if w.ch == nil {
+			w.ch = make(chan struct{})
+		}
+		ch := w.ch
+		w.Unlock()
+
+		select {
+		case <-ch:
+		case <-timer.C:
+			return ErrWaitTimeout
+		}
+	}
+}
+
+// AppliedLSN - end LSN of the last transaction applied to the cache,
+// 0 in trigger capture mode
+func AppliedLSN() pglogrepl.LSN {
+	if captureMode == captureTrigger {
+		return 0
+	}
+	return r.applied.get()
+}
+
+// WaitLSN - blocks until the applied LSN reaches lsn or the timeout expires.
+// lsn is usually taken from pg_current_wal_lsn() right after the write.
+// The trigger capture mode has no WAL positions, it returns ErrNoLSN.
+func WaitLSN(lsn pglogrepl.LSN, timeout time.Duration) error {
+	if captureMode == captureTrigger {
+		return ErrNoLSN
+	}
+	return r.applied.wait(lsn, timeout)
+}
@@ -0,0 +1,105 @@
+package replica
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// pgRelation - pg schema and table
+type pgRelation struct {
+	shema string
+	table string
+}
+
+// serverVersion - server_version_num of the connection
+func serverVersion(conn *pgconn.PgConn) (int, error) {
+	res, err := conn.Exec(ctx, "SHOW server_version_num;").ReadAll()
+	if err != nil {
+		return 0, err
+	}
+	if len(res) == 0 || len(res[0].Rows) == 0 {
+		return 0, fmt.Errorf("server_version_num is empty")
+	}
+	return strconv.Atoi(string(res[0].Rows[0][0]))
+}
+
+// isPartitioned - the table is a partitioned parent
+func isPartitioned(conn *pgconn.PgConn, shema, table string) (bool, error) {
+	res := conn.ExecParams(ctx, `
+		SELECT relkind
+		FROM pg_catalog.pg_class
+		WHERE oid = $1::regclass;
+		`, [][]byte{[]byte(quoteTable(shema, table))}, nil, nil, nil).Read()
+	if res.Err != nil {
+		return false, fmt.Errorf("pg get relkind err: %v", res.Err)
+	}
+	return len(res.Rows) > 0 && string(res.Rows[0][0]) == "p", nil
+}
+
+// leafPartitions - partitions that hold the rows of the partitioned table
+func leafPartitions(conn *pgconn.PgConn, shema, table string) ([]pgRelation, error) {
+	res := conn.ExecParams(ctx, `
+		WITH RECURSIVE tree AS (
+			SELECT $1::regclass::oid AS oid
+			UNION ALL
+			SELECT i.inhrelid
+			FROM pg_catalog.pg_inherits i
+			JOIN tree ON i.inhparent = tree.oid
+		)
+		SELECT n.nspname, c.relname
+		FROM tree
+		JOIN pg_catalog.pg_class c ON c.oid = tree.oid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'f');
+		`, [][]byte{[]byte(quoteTable(shema, table))}, nil, nil, nil).Read()
+	if res.Err != nil {
+		return nil, fmt.Errorf("pg get partitions err: %v", res.Err)
+	}
+	leaves := make([]pgRelation, len(res.Rows))
+	for i, row := range res.Rows {
+		leaves[i] = pgRelation{string(row[0]), string(row[1])}
+	}
+	return leaves, nil
+}
+
+// partitions - fills the partitions of a partitioned table and the relations to publish.
+// Changes of leaf partitions come under their own relations unless
+// the publication is created with publish_via_partition_root.
+func (o *AddOptions) partitions(conn *pgconn.PgConn) error {
+	var err error
+	o.published = []pgRelation{{o.shema, o.table}}
+	o.partitioned, err = isPartitioned(conn, o.shema, o.table)
+	if err != nil || !o.partitioned || r.viaRoot {
+		return err
+	}
+
+	o.leaves, err = leafPartitions(conn, o.shema, o.table)
+	if err != nil {
+		return err
+	}
+	version, err := serverVersion(conn)
+	if err != nil {
+		return err
+	}
+	if version < 130000 || plugin == pluginWal2json || captureMode == captureTrigger {
+		// partitioned tables can't be added to a publication before pg 13,
+		// wal2json add-tables and the capture triggers need the leaves
+		o.published = o.leaves
+	}
+	return nil
+}
+
+// matches - the relation is the table or one of its leaf partitions
+func (o *AddOptions) matches(shema, table string) bool {
+	if o.shema == shema && o.table == table {
+		return true
+	}
+	for _, l := range o.leaves {
+		if l.shema == shema && l.table == table {
+			return true
+		}
+	}
+	return false
+}
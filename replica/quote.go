@@ -0,0 +1,114 @@
+package replica
+
+import (
+	"fmt"
+	"strings"
+)
+
+// quoteIdent - quoted identifier, the same rules for pg and sqlite
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// quoteLiteral - pg string literal, like quote_literal()
+func quoteLiteral(s string) string {
+	s = strings.ReplaceAll(s, `'`, `''`)
+	if strings.Contains(s, `\`) {
+		return `E'` + strings.ReplaceAll(s, `\`, `\\`) + `'`
+	}
+	return `'` + s + `'`
+}
+
+// optionLiteral - string literal of a replication command option, the walsender
+// grammar has no escape strings and keeps backslashes as they are
+func optionLiteral(s string) string {
+	return `'` + strings.ReplaceAll(s, `'`, `''`) + `'`
+}
+
+// quoteTable - quoted pg `<shema>.<table_name>`
+func quoteTable(shema, table string) string {
+	return quoteIdent(shema) + "." + quoteIdent(table)
+}
+
+// quoteTarget - quoted sqlite table name
+func quoteTarget(target string) string {
+	schema, name := splitTarget(target)
+	if schema == "main" {
+		return quoteIdent(name)
+	}
+	return quoteIdent(schema) + "." + quoteIdent(name)
+}
+
+// splitIdent - splits a dotted name. Quoted parts keep dots, case and doubled quotes,
+// unquoted parts are folded to lower case if fold is set.
+func splitIdent(s string, fold bool) ([]string, error) {
+	s = strings.TrimSpace(s)
+	var parts []string
+	var part strings.Builder
+	var quoted, closed bool
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted:
+			if c != '"' {
+				part.WriteByte(c)
+			} else if i+1 < len(s) && s[i+1] == '"' {
+				part.WriteByte(c)
+				i++
+			} else {
+				quoted = false
+				closed = true
+			}
+		case c == '.':
+			if part.Len() == 0 {
+				return nil, fmt.Errorf("empty identifier in %q", s)
+			}
+			parts = append(parts, part.String())
+			part.Reset()
+			closed = false
+		case closed:
+			return nil, fmt.Errorf("unexpected %q after quoted identifier in %q", c, s)
+		case c == '"':
+			if part.Len() > 0 {
+				return nil, fmt.Errorf("unexpected quote in %q", s)
+			}
+			quoted = true
+		default:
+			if fold && 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			part.WriteByte(c)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quoted identifier in %q", s)
+	}
+	if part.Len() == 0 {
+		return nil, fmt.Errorf("empty identifier in %q", s)
+	}
+	return append(parts, part.String()), nil
+}
+
+// parseTableName - pg schema and table of `<shema>.<table_name>`
+func parseTableName(name string) (shema, table string, err error) {
+	parts, err := splitIdent(name, true)
+	if err != nil {
+		return "", "", err
+	}
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("wrong format table %q. TableName format `<shema>.<table_name>`", name)
+	}
+	return parts[0], parts[1], nil
+}
+
+// targetName - sqlite name, the schema is separated by the first dot
+// and omitted for the main database
+func targetName(schema, name string) (string, error) {
+	if strings.Contains(schema, ".") {
+		return "", fmt.Errorf("sqlite schema %q contains a dot", schema)
+	}
+	if schema == "main" && !strings.Contains(name, ".") {
+		return name, nil
+	}
+	return schema + "." + name, nil
+}
@@ -0,0 +1,108 @@
+package replica
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitIdent(t *testing.T) {
+	for _, tc := range []struct {
+		in    string
+		fold  bool
+		parts []string
+		err   bool
+	}{
+		{in: "public.users", fold: true, parts: []string{"public", "users"}},
+		{in: " public.users ", fold: true, parts: []string{"public", "users"}},
+		{in: "Public.Users", fold: true, parts: []string{"public", "users"}},
+		{in: "Public.Users", fold: false, parts: []string{"Public", "Users"}},
+		{in: `"Public"."Users"`, fold: true, parts: []string{"Public", "Users"}},
+		{in: `public."my.table"`, fold: true, parts: []string{"public", "my.table"}},
+		{in: `"a""b".c`, fold: true, parts: []string{`a"b`, "c"}},
+		{in: `"a.""b"""."X"`, fold: true, parts: []string{`a."b"`, "X"}},
+		{in: `Sales."Q1 ""Report"""`, fold: true, parts: []string{"sales", `Q1 "Report"`}},
+		{in: "users", fold: true, parts: []string{"users"}},
+		{in: "", err: true},
+		{in: "public.", err: true},
+		{in: ".users", err: true},
+		{in: "a..b", err: true},
+		{in: `"unterminated`, err: true},
+		{in: `"a"b.c`, err: true},
+		{in: `a"b".c`, err: true},
+	} {
+		parts, err := splitIdent(tc.in, tc.fold)
+		if tc.err {
+			if err == nil {
+				t.Errorf("splitIdent(%q): error expected, got %q", tc.in, parts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitIdent(%q): %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(parts, tc.parts) {
+			t.Errorf("splitIdent(%q, %v) = %q, want %q", tc.in, tc.fold, parts, tc.parts)
+		}
+	}
+}
+
+func TestParseTableName(t *testing.T) {
+	for _, tc := range []struct {
+		in           string
+		shema, table string
+		err          bool
+	}{
+		{in: "public.users", shema: "public", table: "users"},
+		{in: "Public.Users", shema: "public", table: "users"},
+		{in: `"Public"."Users"`, shema: "Public", table: "Users"},
+		{in: `public."orders.2024"`, shema: "public", table: "orders.2024"},
+		{in: `"my""schema".t`, shema: `my"schema`, table: "t"},
+		{in: "users", err: true},
+		{in: "a.b.c", err: true},
+		{in: `"a.b".c.d`, err: true},
+	} {
+		shema, table, err := parseTableName(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parseTableName(%q): error expected", tc.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTableName(%q): %v", tc.in, err)
+			continue
+		}
+		if shema != tc.shema || table != tc.table {
+			t.Errorf("parseTableName(%q) = %q, %q, want %q, %q", tc.in, shema, table, tc.shema, tc.table)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for _, tc := range []struct {
+		fn   func(string) string
+		name string
+		in   string
+		want string
+	}{
+		{quoteLiteral, "quoteLiteral", "abc", `'abc'`},
+		{quoteLiteral, "quoteLiteral", "it's", `'it''s'`},
+		{quoteLiteral, "quoteLiteral", `a\b`, `E'a\\b'`},
+		{quoteLiteral, "quoteLiteral", `it's a\b`, `E'it''s a\\b'`},
+		{quoteLiteral, "quoteLiteral", "", `''`},
+		{quoteIdent, "quoteIdent", "users", `"users"`},
+		{quoteIdent, "quoteIdent", "Users", `"Users"`},
+		{quoteIdent, "quoteIdent", `a"b`, `"a""b"`},
+		{quoteIdent, "quoteIdent", "a.b", `"a.b"`},
+		{optionLiteral, "optionLiteral", `"My.Pub"`, `'"My.Pub"'`},
+		{optionLiteral, "optionLiteral", `it's a\b`, `'it''s a\b'`},
+	} {
+		if got := tc.fn(tc.in); got != tc.want {
+			t.Errorf("%s(%q) = %s, want %s", tc.name, tc.in, got, tc.want)
+		}
+	}
+	if got := quoteTable("Sales", "my.table"); got != `"Sales"."my.table"` {
+		t.Errorf("quoteTable = %s", got)
+	}
+}
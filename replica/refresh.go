@@ -0,0 +1,131 @@
+package replica
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bendersilver/glog"
+)
+
+// refreshState - last and next load of a table by sqlite name
+type refreshState struct {
+	opt  *AddOptions
+	last time.Time
+	next time.Time
+	err  string
+}
+
+// refreshes - mx must be held
+var refreshes = make(map[string]*refreshState)
+
+var refresher sync.Once
+
+// refreshMode - the table is reloaded on a schedule instead of streamed
+func (o *AddOptions) refreshMode() bool {
+	return o.Refresh > 0 || o.RefreshCron != ""
+}
+
+// checkRefresh - parses the refresh schedule
+func (o *AddOptions) checkRefresh() (err error) {
+	if o.Refresh < 0 {
+		return fmt.Errorf("table %s: refresh interval must be positive", o.TableName)
+	}
+	if o.RefreshCron == "" {
+		return nil
+	}
+	if o.Refresh > 0 {
+		return fmt.Errorf("table %s: refresh interval and cron are both set", o.TableName)
+	}
+	o.cron, err = parseCron(o.RefreshCron)
+	return err
+}
+
+// nextRefresh - time of the refresh after t, zero if the table is streamed
+func (o *AddOptions) nextRefresh(t time.Time) time.Time {
+	switch {
+	case o.cron != nil:
+		return o.cron.next(t)
+	case o.Refresh > 0:
+		return t.Add(o.Refresh)
+	}
+	return time.Time{}
+}
+
+// loaded - records a load of the table from pg started at t, mx must be held
+func loaded(opt *AddOptions, t time.Time) {
+	st := refreshes[opt.tableName()]
+	if st == nil {
+		st = new(refreshState)
+		refreshes[opt.tableName()] = st
+	}
+	st.opt = opt
+	st.last, st.err = t, ""
+	st.next = opt.nextRefresh(time.Now())
+}
+
+// startRefresher - checks every second for the tables due a refresh
+func startRefresher() {
+	refresher.Do(func() {
+		go func() {
+			for range time.Tick(time.Second) {
+				for _, opt := range dueRefresh(time.Now()) {
+					err := refreshTable(opt)
+					if err != nil {
+						glog.Errorf("refresh %s err: %v", opt.TableName, err)
+					}
+				}
+			}
+		}()
+	})
+}
+
+// dueRefresh - refresh mode tables whose next refresh has come
+func dueRefresh(now time.Time) []*AddOptions {
+	mx.Lock()
+	defer mx.Unlock()
+	var list []*AddOptions
+	for target, opt := range tables {
+		if !opt.refreshMode() {
+			continue
+		}
+		st := refreshes[target]
+		if st == nil {
+			st = new(refreshState)
+			refreshes[target] = st
+		}
+		if st.opt != opt {
+			// added without a load or rescheduled
+			st.opt = opt
+			st.next = opt.nextRefresh(now)
+		}
+		if !st.next.IsZero() && !now.Before(st.next) {
+			list = append(list, opt)
+		}
+	}
+	return list
+}
+
+// refreshTable - reloads the table into a shadow copy and swaps it in, a failed refresh
+// is retried on the next schedule. The copy runs beside the stream, reload writes sqlite under mx.
+func refreshTable(opt *AddOptions) error {
+	start := time.Now()
+	conn, err := pgConnect()
+	if err != nil {
+		err = fmt.Errorf("pg connerct err: %v", err)
+	} else {
+		err = reload(conn, opt)
+		conn.Close(ctx)
+	}
+	if err != nil {
+		mx.Lock()
+		if st := refreshes[opt.tableName()]; st != nil && st.opt == opt {
+			st.err = err.Error()
+			st.next = opt.nextRefresh(time.Now())
+		}
+		mx.Unlock()
+		return err
+	}
+	glog.Noticef("refreshed %s in %v", opt.TableName, time.Since(start).Round(time.Millisecond))
+	return nil
+}
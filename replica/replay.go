@@ -0,0 +1,121 @@
+package replica
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bendersilver/glog"
+	"github.com/jackc/pglogrepl"
+)
+
+// ReplayOptions -
+type ReplayOptions struct {
+	// Files - capture files, oldest first
+	Files []string
+	// Config - optional, targets, columns and transformations of the tables.
+	// The connection settings are not used.
+	Config *Config
+	// Until - optional LSN, the replay stops before the first event past it
+	Until string
+}
+
+// Replay - applies captured replication messages to a fresh sqlite instead of a live connection.
+// Tables missing in sqlite are created from the column types of the relation messages.
+func Replay(opt ReplayOptions) error {
+	name := plugin
+	if opt.Config != nil && opt.Config.Plugin != "" {
+		name = opt.Config.Plugin
+	}
+	src := &captureSource{files: opt.Files, dec: newDecoder(name)}
+	if opt.Until != "" {
+		var err error
+		src.until, err = pglogrepl.ParseLSN(opt.Until)
+		if err != nil {
+			return err
+		}
+	}
+	defer src.close()
+	return RunSource(src, opt.Config)
+}
+
+// captureSource - events of capture files
+type captureSource struct {
+	files []string
+	until pglogrepl.LSN
+	dec   streamDecoder
+	f     *os.File
+	cr    *captureReader
+	n     int
+	// events - decoded and not returned yet
+	events []*Event
+}
+
+// Next - Source
+func (s *captureSource) Next(ctx context.Context) (*Event, error) {
+	for {
+		if len(s.events) > 0 {
+			ev := s.events[0]
+			s.events = s.events[1:]
+			if s.until != 0 && ev.LSN > s.until {
+				if ev.Kind == EventKeepalive {
+					// the server WAL end may be ahead of the stream
+					continue
+				}
+				glog.Noticef("replay stopped at %s after %d messages", s.until, s.n)
+				s.files, s.events = nil, nil
+				return nil, io.EOF
+			}
+			return ev, nil
+		}
+		if s.cr == nil {
+			if len(s.files) == 0 {
+				return nil, io.EOF
+			}
+			err := s.open(s.files[0])
+			if err != nil {
+				return nil, err
+			}
+			s.files = s.files[1:]
+		}
+		t, data, err := s.cr.next()
+		if err == io.ErrUnexpectedEOF {
+			glog.Warningf("replay %s: the last message is cut", s.f.Name())
+			err = io.EOF
+		}
+		if err == io.EOF {
+			s.close()
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.f.Name(), err)
+		}
+		s.n++
+		s.events, _, err = decodeCopyData(s.dec, data)
+		if err != nil {
+			glog.Errorf("replay %s message %d at %s: %v", s.f.Name(), s.n, t.Format("2006-01-02 15:04:05.000000"), err)
+		}
+	}
+}
+
+func (s *captureSource) open(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	s.cr, err = newCaptureReader(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	s.f = f
+	return nil
+}
+
+func (s *captureSource) close() {
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f, s.cr = nil, nil
+}
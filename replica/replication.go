@@ -3,46 +3,69 @@ package replica
 import (
 	"context"
 	"fmt"
-	"net/url"
+	"strings"
 	"time"
 
 	"github.com/bendersilver/glog"
 	"github.com/bendersilver/pgcache/sqlite"
 	"github.com/jackc/pglogrepl"
 	"github.com/jackc/pgx/v5/pgconn"
-	"github.com/jackc/pgx/v5/pgproto3"
 )
 
 var r replication
 var ctx = context.Background()
 
-// Run -
+// Run - starts replication into a new publication.
+// pgURL may list several hosts, with target_session_attrs=read-write
+// every reconnect goes through them until one is a primary.
 func Run(pgURL string) error {
-	u, err := url.Parse(pgURL)
+	return start(pgURL, false)
+}
+
+// start - keepPublication leaves an existing publication and its tables as they are
+func start(pgURL string, keepPublication bool) error {
+	config, err := pgconn.ParseConfig(connString(pgURL))
 	if err != nil {
 		glog.Error(err)
 		return err
 	}
-	param := url.Values{}
-	param.Add("sslmode", "require")
-	param.Add("replication", "database")
-	param.Add("application_name", slotName)
-	u.RawQuery = param.Encode()
+	if captureMode == captureLogical {
+		config.RuntimeParams["replication"] = "database"
+	}
+	config.RuntimeParams["application_name"] = applicationName()
 
-	r.pgURL = u.String()
+	r.config = config
 	r.relations = make(map[uint32]*relationItem)
 	db, err = sqlite.NewConn()
 	if err != nil {
 		glog.Error(err)
 		return err
 	}
+	startFlusher()
+
+	if captureMode == captureTrigger {
+		conn, err := pgConnect()
+		if err != nil {
+			glog.Error(err)
+			return err
+		}
+		r.host = conn.Conn().RemoteAddr().String()
+		err = installChangelog(conn)
+		conn.Close(ctx)
+		if err != nil {
+			glog.Error(err)
+			return err
+		}
+		go r.runTrigger()
+		return nil
+	}
 
 	err = r.reconnect()
 	if err != nil {
 		glog.Error(err)
 		return err
 	}
-	err = r.createPublication()
+	err = r.createPublication(keepPublication)
 	if err != nil {
 		glog.Error(err)
 		return err
@@ -51,134 +74,219 @@ func Run(pgURL string) error {
 	return nil
 }
 
+// connString - sslmode is required unless the url sets its own
+func connString(pgURL string) string {
+	if strings.Contains(pgURL, "sslmode=") {
+		return pgURL
+	}
+	if !strings.HasPrefix(pgURL, "postgres://") && !strings.HasPrefix(pgURL, "postgresql://") {
+		return pgURL + " sslmode=require"
+	}
+	if strings.Contains(pgURL, "?") {
+		return pgURL + "&sslmode=require"
+	}
+	return pgURL + "?sslmode=require"
+}
+
+// reconnect - connects to the first host accepted by target_session_attrs
 func (r *replication) reconnect() (err error) {
-	if r.conn == nil || r.conn.IsClosed() {
-		r.conn, err = pgconn.Connect(ctx, r.pgURL)
+	if r.conn != nil && !r.conn.IsClosed() {
+		return nil
+	}
+	r.conn, err = pgconn.ConnectConfig(ctx, r.config)
+	if err != nil {
+		return err
+	}
+	host := r.conn.Conn().RemoteAddr().String()
+	mx.Lock()
+	if r.host != "" && r.host != host {
+		glog.Warningf("replication switched from %s to %s", r.host, host)
 	}
-	return
+	r.host = host
+	mx.Unlock()
+	return nil
+}
+
+// pgConnect - regular connection to the source database
+func pgConnect() (*pgconn.PgConn, error) {
+	config := r.config.Copy()
+	delete(config.RuntimeParams, "replication")
+	return pgconn.ConnectConfig(ctx, config)
 }
 
 func (r *replication) run() error {
+	defer r.close()
 
-	err := r.createSlot()
+RECONN:
+	mx.Lock()
+	// the stream restarts after the last committed batch
+	r.flush()
+	r.received = pglogrepl.LSN(0)
+	mx.Unlock()
+	r.inTx = false
+	err := r.reconnect()
 	if err != nil {
-		glog.Warning(err)
+		// no host is available or none of them is a primary yet
+		glog.Error(err)
+		time.Sleep(time.Second * 5)
+		goto RECONN
 	}
-	defer r.close()
 
-RECONN:
-	r.lsn = pglogrepl.LSN(0)
-	err = r.reconnect()
+	err = r.prepareSlot()
 	if err != nil {
 		glog.Error(err)
-		return err
+		time.Sleep(time.Second * 5)
+		goto RECONN
 	}
 
 	err = r.startReplication()
 	if err != nil {
+		// the slot is checked again on reconnect
 		glog.Error(err)
-		return err
+		time.Sleep(time.Second * 5)
+		goto RECONN
 	}
-	timeout := time.Second * 10
-	nextStandbyMessageDeadline := time.Now().Add(timeout)
+	sctx, cancel := context.WithCancel(ctx)
+	mx.Lock()
+	r.cancel = cancel
+	mx.Unlock()
+	src := newStreamSource(r.conn, newDecoder(plugin), r.sendStatus)
 	for {
-
-		if time.Now().After(nextStandbyMessageDeadline) {
-			err = pglogrepl.SendStandbyStatusUpdate(
-				ctx,
-				r.conn,
-				pglogrepl.StandbyStatusUpdate{
-					WALWritePosition: r.lsn,
-				},
-			)
-
-			if err != nil {
-				glog.Error(err)
-				return err
-			}
-			nextStandbyMessageDeadline = time.Now().Add(timeout)
-		}
-
-		ctx, cancel := context.WithDeadline(context.Background(), nextStandbyMessageDeadline)
-		rawMsg, err := r.conn.ReceiveMessage(ctx)
-		cancel()
-
+		ev, err := src.Next(sctx)
 		if err != nil {
-			if pgconn.Timeout(err) {
-				continue
+			r.conn.Close(ctx)
+			if sctx.Err() != nil {
+				glog.Notice("restarting replication")
+				goto RECONN
 			}
+			cancel()
 			glog.Error(err)
 			time.Sleep(time.Second * 5)
 			goto RECONN
 		}
-
-		if rawMsg == nil {
-			return fmt.Errorf("replication failed: nil message received, should not happen")
-		}
-
-		if errMsg, ok := rawMsg.(*pgproto3.ErrorResponse); ok {
-			glog.Critical(errMsg)
-			// restart
-			return fmt.Errorf("received Postgres WAL error: %+v", errMsg)
+		err = r.event(ev)
+		if err != nil {
+			glog.Error(err)
 		}
+	}
+}
 
-		msg, ok := rawMsg.(*pgproto3.CopyData)
-		if !ok {
-			glog.Warning("replication received unexpected message: %T\n", msg)
-			continue
-		}
+// keepalive - everything before lsn has been sent, nothing is pending between transactions
+func (r *replication) keepalive(lsn pglogrepl.LSN) {
+	mx.Lock()
+	defer mx.Unlock()
+	if !r.inTx && lsn > r.received {
+		r.received = lsn
+		r.commit(lsn)
+	}
+}
 
-		switch msg.Data[0] {
-		case pglogrepl.PrimaryKeepaliveMessageByteID:
-			pkm, err := pglogrepl.ParsePrimaryKeepaliveMessage(msg.Data[1:])
-			if err != nil {
-				glog.Error(err)
-				return err
-			}
-			if pkm.ReplyRequested {
-				nextStandbyMessageDeadline = time.Time{}
-			}
-		case pglogrepl.XLogDataByteID:
-			r.handle(msg)
-		}
+// sendStatus - reports received WAL as written, committed transactions as flushed and applied.
+// The positions are copied under mx, batches are committed from other goroutines.
+func (r *replication) sendStatus() error {
+	mx.Lock()
+	ssu := pglogrepl.StandbyStatusUpdate{
+		WALWritePosition: r.received,
+		WALFlushPosition: r.flushed,
+		WALApplyPosition: r.applied.get(),
+	}
+	mx.Unlock()
+	if ssu.WALFlushPosition == 0 {
+		// nothing committed yet, zero positions keep pglogrepl from reporting the write position as flushed
+		ssu.WALWritePosition = 0
 	}
+	return pglogrepl.SendStandbyStatusUpdate(ctx, r.conn, ssu)
 }
 
 func (r *replication) dropPublication() error {
-	sql := fmt.Sprintf("DROP PUBLICATION IF EXISTS %s;", slotName)
+	sql := fmt.Sprintf("DROP PUBLICATION IF EXISTS %s;", quoteIdent(publication()))
 	_, err := r.conn.Exec(ctx, sql).ReadAll()
 	return err
 }
 
-func (r *replication) createPublication() error {
+// createPublication - keep or an external publication only reads publish_via_partition_root
+func (r *replication) createPublication(keep bool) error {
+	if plugin != pluginPgoutput {
+		return nil
+	}
+	if keep || externalPublication {
+		res, err := r.conn.Exec(ctx, fmt.Sprintf(`
+			SELECT coalesce(to_jsonb(p) ->> 'pubviaroot', 'false')
+			FROM pg_catalog.pg_publication p
+			WHERE pubname = %s;
+			`, quoteLiteral(publication()))).ReadAll()
+		if err != nil {
+			return err
+		}
+		if len(res) > 0 && len(res[0].Rows) > 0 {
+			r.viaRoot = string(res[0].Rows[0][0]) == "true"
+			return nil
+		}
+		if externalPublication {
+			return fmt.Errorf("publication %s does not exist", publication())
+		}
+	}
 	err := r.dropPublication()
 	if err != nil {
 		return err
 	}
-	sql := fmt.Sprintf("CREATE PUBLICATION %s;", slotName)
+	version, err := serverVersion(r.conn)
+	if err != nil {
+		return err
+	}
+	sql := fmt.Sprintf("CREATE PUBLICATION %s;", quoteIdent(publication()))
+	if version >= 130000 {
+		sql = fmt.Sprintf("CREATE PUBLICATION %s WITH (publish_via_partition_root = true);", quoteIdent(publication()))
+	}
 	_, err = r.conn.Exec(ctx, sql).ReadAll()
-	return err
+	if err != nil {
+		return err
+	}
+	r.viaRoot = version >= 130000
+	return nil
 }
 
-func (r *replication) createSlot() error {
-
-	_, err := pglogrepl.CreateReplicationSlot(ctx,
-		r.conn,
-		slotName,
-		plugin,
-		pglogrepl.CreateReplicationSlotOptions{},
-	)
-	return err
+// createSlot - creates the slot and returns the name of the snapshot it exports.
+// On PG17+ the slot is created with failover enabled, standbys with
+// sync_replication_slots keep a copy that survives promotion. A temporary slot can't fail over.
+func (r *replication) createSlot() (string, error) {
+	version, err := serverVersion(r.conn)
+	if err != nil {
+		return "", err
+	}
+	var temporary string
+	if temporarySlot {
+		temporary = " TEMPORARY"
+	}
+	sql := fmt.Sprintf("CREATE_REPLICATION_SLOT %s%s LOGICAL %s", quoteIdent(slotName), temporary, plugin)
+	switch {
+	case version >= 170000 && !temporarySlot:
+		sql += " (SNAPSHOT 'export', FAILOVER true)"
+	case version >= 150000:
+		sql += " (SNAPSHOT 'export')"
+	default:
+		sql += " EXPORT_SNAPSHOT"
+	}
+	res, err := pglogrepl.ParseCreateReplicationSlot(r.conn.Exec(ctx, sql))
+	if err != nil {
+		return "", err
+	}
+	return res.SnapshotName, nil
 }
 
 func (r *replication) close() {
-	err := pglogrepl.DropReplicationSlot(ctx, r.conn, slotName, pglogrepl.DropReplicationSlotOptions{})
-	if err != nil {
-		glog.Error(err)
+	var err error
+	if !temporarySlot {
+		err = pglogrepl.DropReplicationSlot(ctx, r.conn, slotName, pglogrepl.DropReplicationSlotOptions{})
+		if err != nil {
+			glog.Error(err)
+		}
 	}
-	err = r.dropPublication()
-	if err != nil {
-		glog.Error(err)
+	if managedPublication() {
+		err = r.dropPublication()
+		if err != nil {
+			glog.Error(err)
+		}
 	}
 	err = r.conn.Close(ctx)
 	if err != nil {
@@ -188,15 +296,39 @@ func (r *replication) close() {
 }
 
 func (r *replication) startReplication() error {
+	args := []string{
+		"proto_version '1'",
+		// pgoutput parses the names as an identifier list
+		"publication_names " + optionLiteral(quoteIdent(publication())),
+	}
+	if plugin == pluginWal2json {
+		mx.Lock()
+		var list []pgRelation
+		for _, opt := range tables {
+			list = append(list, opt.published...)
+		}
+		for _, l := range loads {
+			list = append(list, l.opt.published...)
+		}
+		mx.Unlock()
+		args = wal2jsonArgs(list)
+	}
+	mx.Lock()
+	flushed := r.flushed
+	mx.Unlock()
+	glog.Noticef("starting replication from %s", flushed)
 	return pglogrepl.StartReplication(ctx,
 		r.conn,
 		slotName,
-		r.lsn,
-		pglogrepl.StartReplicationOptions{
-			PluginArgs: []string{
-				"proto_version '1'",
-				"publication_names '" + slotName + "'",
-			},
-		},
+		flushed,
+		pglogrepl.StartReplicationOptions{PluginArgs: args},
 	)
 }
+
+// restartStream - restarts the replication from the flushed position,
+// wal2json reads the changed table list on start. mx must be held.
+func (r *replication) restartStream() {
+	if plugin == pluginWal2json && r.cancel != nil {
+		r.cancel()
+	}
+}
@@ -0,0 +1,272 @@
+package replica
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bendersilver/glog"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// slot states
+const (
+	slotOK = iota
+	slotMissing
+	slotLost
+)
+
+// slotState - looks the slot up in pg_replication_slots.
+// wal_status, conflicting and failover are read through jsonb, older servers don't have them.
+// noFailover - a PG17+ slot exists without failover.
+func (r *replication) slotState() (state int, noFailover bool, err error) {
+	res, err := r.conn.Exec(ctx, fmt.Sprintf(`
+		SELECT coalesce(to_jsonb(s) ->> 'wal_status', ''),
+			coalesce(to_jsonb(s) ->> 'conflicting', 'false'),
+			coalesce(to_jsonb(s) ->> 'failover', '')
+		FROM pg_catalog.pg_replication_slots s
+		WHERE slot_name = %s;
+		`, quoteLiteral(slotName))).ReadAll()
+	if err != nil {
+		return 0, false, fmt.Errorf("pg get pg_replication_slots err: %v", err)
+	}
+	if len(res) == 0 || len(res[0].Rows) == 0 {
+		return slotMissing, false, nil
+	}
+	row := res[0].Rows[0]
+	if string(row[0]) == "lost" || string(row[1]) == "true" {
+		return slotLost, false, nil
+	}
+	return slotOK, string(row[2]) == "false", nil
+}
+
+// prepareSlot - creates a missing slot, drops and creates an invalidated one.
+// Changes between the old and the new slot are lost, so every cached table is reloaded
+// in the snapshot exported by the new slot, the stream starts right after it.
+// Failover is enabled on a PG17+ slot created without it.
+func (r *replication) prepareSlot() error {
+	state, noFailover, err := r.slotState()
+	if err != nil {
+		return err
+	}
+	switch {
+	case state == slotOK && !r.reload:
+		if noFailover && !temporarySlot {
+			// created before the upgrade to PG17 or by an older version
+			_, err = r.conn.Exec(ctx, fmt.Sprintf("ALTER_REPLICATION_SLOT %s (FAILOVER true)", quoteIdent(slotName))).ReadAll()
+			if err != nil {
+				glog.Warningf("enable failover of slot %s err: %v", slotName, err)
+			}
+		}
+		return nil
+	case state == slotOK:
+		// the snapshot of the slot ended with the failed reload
+		glog.Warningf("reload of cached tables failed, recreating replication slot %s", slotName)
+	case state == slotLost:
+		glog.Warningf("replication slot %s is invalidated, recreating it and reloading cached tables", slotName)
+	default:
+		mx.Lock()
+		cached := len(tables)
+		mx.Unlock()
+		if cached > 0 && !temporarySlot {
+			glog.Warningf("replication slot %s is missing, recreating it and reloading cached tables", slotName)
+		}
+	}
+	if state != slotMissing {
+		err = pglogrepl.DropReplicationSlot(ctx, r.conn, slotName, pglogrepl.DropReplicationSlotOptions{})
+		if err != nil {
+			return fmt.Errorf("drop slot err: %v", err)
+		}
+	}
+	snapshot, err := r.createSlot()
+	if err != nil {
+		return fmt.Errorf("create slot err: %v", err)
+	}
+	// the new slot starts from its own consistent point
+	mx.Lock()
+	r.flushed = 0
+	mx.Unlock()
+	r.reload = true
+	// the snapshot is valid until the next command of the replication connection
+	err = reloadTables(snapshot)
+	if err != nil {
+		return err
+	}
+	r.reload = false
+	return nil
+}
+
+// reloadTables - reloads every cached table in the exported snapshot of the slot,
+// the rows match the consistent point the stream starts from
+func reloadTables(snapshot string) error {
+	mx.Lock()
+	list := make([]*AddOptions, 0, len(tables))
+	for _, opt := range tables {
+		list = append(list, opt)
+	}
+	mx.Unlock()
+	if len(list) == 0 {
+		return nil
+	}
+
+	conn, err := pgConnect()
+	if err != nil {
+		return fmt.Errorf("pg connerct err: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, fmt.Sprintf(`
+		BEGIN ISOLATION LEVEL REPEATABLE READ;
+		SET TRANSACTION SNAPSHOT %s;
+		`, quoteLiteral(snapshot))).ReadAll()
+	if err != nil {
+		return fmt.Errorf("pg set snapshot err: %v", err)
+	}
+	for _, opt := range list {
+		err = reload(conn, opt)
+		if err != nil {
+			return fmt.Errorf("reload %s err: %v", opt.TableName, err)
+		}
+	}
+	_, err = conn.Exec(ctx, "COMMIT;").ReadAll()
+	if err != nil {
+		return fmt.Errorf("pg commit err: %v", err)
+	}
+	glog.Noticef("reloaded %d cached tables", len(list))
+	return nil
+}
+
+// resyncs - changes streamed while the shadow copy of a table is loading, by sqlite name
+var resyncs = make(map[string]*changeLog)
+
+// changeLog - raw events, they are decoded on replay with the options of the new load
+type changeLog struct {
+	rels   []*Relation
+	events []*Event
+}
+
+// add - keeps a change of the table, the decoded values may share the receive buffer
+func (cl *changeLog) add(rel *Relation, ev *Event) {
+	cp := *ev
+	cp.Old, cp.New = copyValues(ev.Old), copyValues(ev.New)
+	cl.rels = append(cl.rels, rel)
+	cl.events = append(cl.events, &cp)
+}
+
+// startLog - starts keeping the changes streamed for the table
+func startLog(target string) (*changeLog, error) {
+	mx.Lock()
+	defer mx.Unlock()
+	if _, ok := resyncs[target]; ok {
+		return nil, fmt.Errorf("resync of %s is already running", target)
+	}
+	cl := new(changeLog)
+	resyncs[target] = cl
+	return cl, nil
+}
+
+func stopLog(target string) {
+	mx.Lock()
+	delete(resyncs, target)
+	mx.Unlock()
+}
+
+// replay - applies the kept changes to the table, projected and transformed by opt.
+// A change may be older than the copied rows, so the rows of its keys are replaced.
+func (cl *changeLog) replay(table string, opt *AddOptions) error {
+	items := make(map[*Relation]*relationItem)
+	defer func() {
+		for _, ri := range items {
+			ri.close()
+		}
+	}()
+	for i, ev := range cl.events {
+		rel := cl.rels[i]
+		ri, ok := items[rel]
+		if !ok {
+			var err error
+			ri, err = newTableItem(rel, table, opt)
+			if err != nil {
+				return err
+			}
+			items[rel] = ri
+		}
+		c, err := ri.decode(ev)
+		if err != nil {
+			glog.Error(err)
+			continue
+		}
+		if c == nil {
+			continue
+		}
+		err = ri.set(c)
+		if err != nil {
+			return fmt.Errorf("replay err: %v", err)
+		}
+	}
+	return nil
+}
+
+// reload - fills a shadow copy of the table from a snapshot, replays the changes
+// streamed during the copy and swaps it in. Readers see the old rows until the swap,
+// the stream goes on between the parts of the copy.
+func reload(conn *pgconn.PgConn, opt *AddOptions) error {
+	start := time.Now()
+	target := opt.tableName()
+	shadow := target + "__shadow"
+
+	cl, err := startLog(target)
+	if err != nil {
+		return err
+	}
+	defer stopLog(target)
+
+	mx.Lock()
+	var t *tmpTable
+	err = db.Exec("DROP TABLE IF EXISTS " + quoteTarget(shadow) + ";")
+	if err == nil {
+		t, err = createTable(conn, opt, shadow)
+	}
+	mx.Unlock()
+	if err == nil {
+		t.shared = true
+		err = t.fill(conn)
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+	if t != nil {
+		t.insert.Close()
+	}
+	if err != nil {
+		db.Exec("DROP TABLE IF EXISTS " + quoteTarget(shadow) + ";")
+		return err
+	}
+	r.flush()
+	err = cl.replay(shadow, opt)
+	if err != nil {
+		db.Exec("DROP TABLE IF EXISTS " + quoteTarget(shadow) + ";")
+		return err
+	}
+	err = swap(shadow, target)
+	if err != nil {
+		return err
+	}
+	loaded(opt, start)
+	return nil
+}
+
+// swap - replaces target with shadow in one transaction
+func swap(shadow, target string) error {
+	_, name := splitTarget(target)
+	err := db.Exec(fmt.Sprintf(`
+		BEGIN;
+		DROP TABLE IF EXISTS %s;
+		ALTER TABLE %s RENAME TO %s;
+		COMMIT;`, quoteTarget(target), quoteTarget(shadow), quoteIdent(name)))
+	if err != nil {
+		db.Exec("ROLLBACK;")
+		return fmt.Errorf("sqlite swap err: %v", err)
+	}
+	return nil
+}
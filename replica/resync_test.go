@@ -0,0 +1,100 @@
+package replica
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// replayRuns - tests run so far, every run has its own table
+var replayRuns int
+
+func TestChangeLogReplay(t *testing.T) {
+	runEvents(t, nil)
+	replayRuns++
+	table := fmt.Sprintf("replay%d_items", replayRuns)
+	err := db.Exec(fmt.Sprintf("CREATE TABLE %s (id INTEGER, name TEXT, qty INTEGER);", quoteTarget(table)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the copy already has the first changes of the log
+	err = db.Exec(fmt.Sprintf("INSERT INTO %s VALUES (1, 'a', 5), (2, 'b', 6), (3, 'c', 7);", quoteTarget(table)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rel := itemsRelation(1, "replay").Relation
+	cl := new(changeLog)
+	for _, ev := range []*Event{
+		insertEvent(1, int64(1), "a", int64(5)),
+		updateEvent(1, nil, int64(2), "b", int64(6)),
+		// streamed after the copy
+		updateEvent(1, keyRow(int64(2), nil, nil), int64(20), "b2", int64(6)),
+		insertEvent(1, int64(4), "d", int64(8)),
+		deleteEvent(1, int64(3), nil, nil),
+	} {
+		cl.add(rel, ev)
+	}
+
+	mx.Lock()
+	err = cl.replay(table, nil)
+	mx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"1 a 5", "4 d 8", "20 b2 6"}
+	if rows := cachedRows(t, table); !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows %q, want %q", rows, want)
+	}
+}
+
+func TestSharedCopy(t *testing.T) {
+	runEvents(t, nil)
+	replayRuns++
+	table := fmt.Sprintf("replay%d_shared", replayRuns)
+	err := db.Exec(fmt.Sprintf("CREATE TABLE %s (id INTEGER, name TEXT, ok BOOLEAN);", quoteTarget(table)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert, err := db.Prepare((*AddOptions)(nil).insertSQL("INSERT", table, []string{"id", "name", "ok"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer insert.Close()
+
+	n := shareRows*2 + shareRows/2
+	s := newCopyStream(0, nil)
+	for i := 1; i <= n; i++ {
+		s.row(int8Bytes(int64(i)), []byte(fmt.Sprint("row", i)), []byte{1})
+	}
+	s.trailer()
+
+	// the stream has an open batch, the copied rows must not join it
+	mx.Lock()
+	r.begin()
+	mx.Unlock()
+	tt := &tmpTable{field: copyFields, names: []string{"id", "name", "ok"}, insert: insert, shared: true}
+	for rest := s.Bytes(); len(rest) > 0; rest = rest[1:] {
+		_, err = tt.Write(rest[:1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mx.Lock()
+	open := r.batch.open
+	mx.Unlock()
+	if open {
+		t.Error("batch of the stream is still open")
+	}
+	if tt.rows != int64(n) {
+		t.Errorf("rows %d, want %d", tt.rows, n)
+	}
+	rows := cachedRows(t, table)
+	if len(rows) != n || rows[0] != "1 row1 true" || rows[n-1] != fmt.Sprintf("%d row%d true", n, n) {
+		t.Errorf("%d rows, first %q", len(rows), rows[:1])
+	}
+}
@@ -0,0 +1,208 @@
+package replica
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bendersilver/glog"
+	"github.com/bendersilver/pgcache/sqlite"
+	"github.com/jackc/pglogrepl"
+)
+
+// EventKind -
+type EventKind int
+
+// event kinds
+const (
+	EventRelation EventKind = iota + 1
+	EventBegin
+	EventCommit
+	EventInsert
+	EventUpdate
+	EventDelete
+	EventTruncate
+	// EventKeepalive - the source has sent everything before LSN, no transaction is pending
+	EventKeepalive
+)
+
+var eventKinds = []string{"", "relation", "begin", "commit", "insert", "update", "delete", "truncate", "keepalive"}
+
+func (k EventKind) String() string {
+	if k > 0 && int(k) < len(eventKinds) {
+		return eventKinds[k]
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+func parseEventKind(s string) (EventKind, error) {
+	for i, v := range eventKinds {
+		if v != "" && v == strings.ToLower(s) {
+			return EventKind(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown event kind %q", s)
+}
+
+// Column - column of a source relation
+type Column struct {
+	Name string `json:"name"`
+	// Type - pg type oid
+	Type uint32 `json:"type"`
+	// Key - part of the replica identity
+	Key bool `json:"key"`
+}
+
+// Relation - source table, sent before the first change of it and after it is altered
+type Relation struct {
+	ID        uint32   `json:"id"`
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Columns   []Column `json:"columns"`
+}
+
+// Event - change of the source
+type Event struct {
+	Kind EventKind
+	// LSN - source position after the event, the end of the transaction for a commit
+	LSN pglogrepl.LSN
+	// Relation - EventRelation
+	Relation *Relation
+	// RelationID - insert, update and delete
+	RelationID uint32
+	// RelationIDs - truncate, the relations truncated by one statement
+	RelationIDs []uint32
+	// Cascade, RestartIdentity - options of the truncate statement
+	Cascade         bool
+	RestartIdentity bool
+	// Old - old row or its key columns of an update or delete, nil if not sent.
+	// New - row of an insert or update. Values are in the relation column order.
+	Old []driver.Value
+	New []driver.Value
+}
+
+// Source - stream of change events
+type Source interface {
+	// Next - blocks until the next event, io.EOF after the last event of a finite source
+	Next(ctx context.Context) (*Event, error)
+}
+
+// createTables - tables missing in sqlite are created from the relation events,
+// set when the events don't come from a live pg with loaded tables
+var createTables bool
+
+// RunSource - applies the events of src to a fresh sqlite until src ends.
+// cfg is optional, it sets targets, columns and transformations of the tables.
+// Tables missing in sqlite are created from the column types of the relation events.
+func RunSource(src Source, cfg *Config) error {
+	var err error
+	db, err = sqlite.NewConn()
+	if err != nil {
+		return err
+	}
+	createTables = true
+	r.relations = make(map[uint32]*relationItem)
+	if cfg != nil {
+		err = cfg.setBatch()
+		if err != nil {
+			return err
+		}
+		for _, t := range cfg.Tables {
+			o, err := t.options()
+			if err != nil {
+				return err
+			}
+			err = o.parse()
+			if err != nil {
+				return err
+			}
+			mx.Lock()
+			tables[o.tableName()] = o
+			mx.Unlock()
+		}
+	}
+	startFlusher()
+
+	var n int
+	for {
+		ev, err := src.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		err = r.event(ev)
+		if err != nil {
+			glog.Errorf("event %d %s at %s: %v", n, ev.Kind, ev.LSN, err)
+		}
+		n++
+	}
+	mx.Lock()
+	r.flush()
+	mx.Unlock()
+	glog.Noticef("source done, %d events, applied %s", n, r.applied.get())
+	return nil
+}
+
+// MemorySource - events pushed by the program, e.g. a test
+type MemorySource struct {
+	ch chan *Event
+}
+
+// NewMemorySource - buffer is the number of events pushed without blocking
+func NewMemorySource(buffer int) *MemorySource {
+	return &MemorySource{ch: make(chan *Event, buffer)}
+}
+
+// Push - blocks until the event is buffered
+func (s *MemorySource) Push(events ...*Event) {
+	for _, ev := range events {
+		s.ch <- ev
+	}
+}
+
+// Close - Next returns io.EOF after the pushed events
+func (s *MemorySource) Close() {
+	close(s.ch)
+}
+
+// Next - Source
+func (s *MemorySource) Next(ctx context.Context) (*Event, error) {
+	select {
+	case ev, ok := <-s.ch:
+		if !ok {
+			return nil, io.EOF
+		}
+		return ev, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// createSourceTable - creates the sqlite table of a source relation if it is missing
+func createSourceTable(m *Relation, opt *AddOptions, target string) error {
+	schema, _ := splitTarget(target)
+	err := db.Attach(schema)
+	if err != nil {
+		return err
+	}
+	var create []string
+	for _, c := range m.Columns {
+		if opt != nil && len(opt.Columns) > 0 && !contains(opt.Columns, c.Name) {
+			continue
+		}
+		create = append(create, quoteIdent(c.Name)+" "+sqliteType(c.Type))
+	}
+	if opt != nil {
+		for _, c := range opt.Computed {
+			create = append(create, strings.TrimSpace(quoteIdent(c.Name)+" "+c.Type))
+		}
+	}
+	if len(create) == 0 {
+		return nil
+	}
+	return db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n%s\n);", quoteTarget(target), strings.Join(create, ",\n")))
+}
@@ -0,0 +1,152 @@
+package replica
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// ndjsonEvent - line of an NDJSON source, e.g.
+//
+//	{"kind": "relation", "relation": {"id": 1, "namespace": "public", "name": "users",
+//		"columns": [{"name": "id", "type": 20, "key": true}, {"name": "email", "type": 25}]}}
+//	{"kind": "begin"}
+//	{"kind": "insert", "relation_id": 1, "new": [1, "a@example.com"]}
+//	{"kind": "commit", "lsn": "0/16B3748"}
+//
+// Values are in the pg text format of the column type, numbers, booleans and json may be plain json.
+type ndjsonEvent struct {
+	Kind            string            `json:"kind"`
+	LSN             string            `json:"lsn"`
+	Relation        *Relation         `json:"relation"`
+	RelationID      uint32            `json:"relation_id"`
+	RelationIDs     []uint32          `json:"relation_ids"`
+	Cascade         bool              `json:"cascade"`
+	RestartIdentity bool              `json:"restart_identity"`
+	Old             []json.RawMessage `json:"old"`
+	New             []json.RawMessage `json:"new"`
+}
+
+// NDJSONSource - events of newline delimited json
+type NDJSONSource struct {
+	sc   *bufio.Scanner
+	line int
+	rels map[uint32]*Relation
+}
+
+// NewNDJSONSource -
+func NewNDJSONSource(rd io.Reader) *NDJSONSource {
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(make([]byte, 64<<10), 64<<20)
+	return &NDJSONSource{sc: sc, rels: make(map[uint32]*Relation)}
+}
+
+// Next - Source
+func (s *NDJSONSource) Next(ctx context.Context) (*Event, error) {
+	for s.sc.Scan() {
+		s.line++
+		line := bytes.TrimSpace(s.sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		ev, err := s.event(line)
+		if err != nil {
+			return nil, fmt.Errorf("ndjson line %d: %v", s.line, err)
+		}
+		return ev, nil
+	}
+	if err := s.sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (s *NDJSONSource) event(line []byte) (ev *Event, err error) {
+	var je ndjsonEvent
+	err = json.Unmarshal(line, &je)
+	if err != nil {
+		return nil, err
+	}
+	ev = &Event{
+		RelationID:      je.RelationID,
+		RelationIDs:     je.RelationIDs,
+		Cascade:         je.Cascade,
+		RestartIdentity: je.RestartIdentity,
+	}
+	ev.Kind, err = parseEventKind(je.Kind)
+	if err != nil {
+		return nil, err
+	}
+	if je.LSN != "" {
+		ev.LSN, err = pglogrepl.ParseLSN(je.LSN)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch ev.Kind {
+	case EventRelation:
+		if je.Relation == nil {
+			return nil, fmt.Errorf("relation is missing")
+		}
+		s.rels[je.Relation.ID] = je.Relation
+		ev.Relation = je.Relation
+	case EventInsert, EventUpdate, EventDelete:
+		ev.Old, err = s.values(je.RelationID, je.Old)
+		if err != nil {
+			return nil, err
+		}
+		ev.New, err = s.values(je.RelationID, je.New)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ev, nil
+}
+
+// values - decoded by the column types of the relation
+func (s *NDJSONSource) values(relID uint32, raw []json.RawMessage) ([]driver.Value, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	rel, ok := s.rels[relID]
+	if !ok {
+		return nil, fmt.Errorf("relation %d not found", relID)
+	}
+	if len(raw) != len(rel.Columns) {
+		return nil, fmt.Errorf("%d values, relation %d has %d columns", len(raw), relID, len(rel.Columns))
+	}
+	vals := make([]driver.Value, len(raw))
+	for i, v := range raw {
+		var err error
+		vals[i], err = jsonValue(rel.Columns[i].Type, v)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", rel.Columns[i].Name, err)
+		}
+	}
+	return vals, nil
+}
+
+// jsonValue - value of the pg type oid, a json string holds the pg text format,
+// other json values are decoded from their text
+func jsonValue(oid uint32, v json.RawMessage) (driver.Value, error) {
+	if len(v) == 0 || string(v) == "null" {
+		return nil, nil
+	}
+	text := []byte(v)
+	if v[0] == '"' {
+		var str string
+		err := json.Unmarshal(v, &str)
+		if err != nil {
+			return nil, err
+		}
+		text = []byte(str)
+	}
+	return decodeColumn(pgtype.TextFormatCode, oid, text)
+}
@@ -0,0 +1,125 @@
+package replica
+
+import (
+	"database/sql/driver"
+	"fmt"
+
+	"github.com/bendersilver/glog"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// option bits of the truncate message
+const (
+	truncateCascade         = 1
+	truncateRestartIdentity = 2
+)
+
+// pgoutputDecoder - turns pgoutput messages into events
+type pgoutputDecoder struct {
+	rels map[uint32]*pglogrepl.RelationMessage
+}
+
+func newPgoutputDecoder() *pgoutputDecoder {
+	return &pgoutputDecoder{rels: make(map[uint32]*pglogrepl.RelationMessage)}
+}
+
+// decode - streamDecoder
+func (d *pgoutputDecoder) decode(xld pglogrepl.XLogData) ([]*Event, error) {
+	msg, err := pglogrepl.Parse(xld.WALData)
+	if err != nil {
+		return nil, err
+	}
+	ev, err := d.event(msg)
+	if ev == nil || err != nil {
+		return nil, err
+	}
+	if ev.LSN == 0 {
+		ev.LSN = xld.WALStart + pglogrepl.LSN(len(xld.WALData))
+	}
+	return []*Event{ev}, nil
+}
+
+func (d *pgoutputDecoder) event(msg pglogrepl.Message) (*Event, error) {
+	switch msg := msg.(type) {
+	case *pglogrepl.RelationMessage:
+		d.rels[msg.RelationID] = msg
+		rel := &Relation{
+			ID:        msg.RelationID,
+			Namespace: msg.Namespace,
+			Name:      msg.RelationName,
+			Columns:   make([]Column, len(msg.Columns)),
+		}
+		for i, c := range msg.Columns {
+			rel.Columns[i] = Column{Name: c.Name, Type: c.DataType, Key: c.Flags == 1}
+		}
+		return &Event{Kind: EventRelation, Relation: rel}, nil
+
+	case *pglogrepl.InsertMessage:
+		row, err := d.tuple(msg.RelationID, msg.Tuple)
+		if err != nil {
+			return nil, err
+		}
+		return &Event{Kind: EventInsert, RelationID: msg.RelationID, New: row}, nil
+
+	case *pglogrepl.UpdateMessage:
+		old, err := d.tuple(msg.RelationID, msg.OldTuple)
+		if err != nil {
+			return nil, err
+		}
+		row, err := d.tuple(msg.RelationID, msg.NewTuple)
+		if err != nil {
+			return nil, err
+		}
+		return &Event{Kind: EventUpdate, RelationID: msg.RelationID, Old: old, New: row}, nil
+
+	case *pglogrepl.DeleteMessage:
+		old, err := d.tuple(msg.RelationID, msg.OldTuple)
+		if err != nil {
+			return nil, err
+		}
+		return &Event{Kind: EventDelete, RelationID: msg.RelationID, Old: old}, nil
+
+	case *pglogrepl.TruncateMessage:
+		return &Event{
+			Kind:            EventTruncate,
+			RelationIDs:     msg.RelationIDs,
+			Cascade:         msg.Option&truncateCascade != 0,
+			RestartIdentity: msg.Option&truncateRestartIdentity != 0,
+		}, nil
+
+	case *pglogrepl.BeginMessage:
+		return &Event{Kind: EventBegin}, nil
+
+	case *pglogrepl.CommitMessage:
+		return &Event{Kind: EventCommit, LSN: msg.TransactionEndLSN}, nil
+	}
+	return nil, nil
+}
+
+// tuple - decoded values in the relation column order, nil for a missing tuple
+func (d *pgoutputDecoder) tuple(relID uint32, tuple *pglogrepl.TupleData) (vals []driver.Value, err error) {
+	if tuple == nil {
+		return nil, nil
+	}
+	rel, ok := d.rels[relID]
+	if !ok {
+		return nil, fmt.Errorf("relation %d not found", relID)
+	}
+	vals = make([]driver.Value, len(rel.Columns))
+	for ix, col := range tuple.Columns {
+		switch col.DataType {
+		case 'n':
+			vals[ix] = nil
+		case 'u': // unchanged toast
+			// This TOAST value was not changed. TOAST values are not stored in the tuple, and logical replication doesn't want to spend a disk read to fetch its value for you.
+		case 't': //text
+			vals[ix], err = decodeColumn(pgtype.TextFormatCode, rel.Columns[ix].DataType, col.Data)
+			if err != nil {
+				glog.Error(err)
+				return nil, err
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,120 @@
+package replica
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bendersilver/glog"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// streamDecoder - turns the WAL data of an output plugin into events
+type streamDecoder interface {
+	decode(xld pglogrepl.XLogData) ([]*Event, error)
+}
+
+// newDecoder - decoder of the output plugin
+func newDecoder(plugin string) streamDecoder {
+	if plugin == pluginWal2json {
+		return newWal2jsonDecoder()
+	}
+	return newPgoutputDecoder()
+}
+
+// decodeCopyData - events of a CopyData payload, reply is requested by a keepalive
+func decodeCopyData(dec streamDecoder, data []byte) ([]*Event, bool, error) {
+	switch data[0] {
+	case pglogrepl.PrimaryKeepaliveMessageByteID:
+		pkm, err := pglogrepl.ParsePrimaryKeepaliveMessage(data[1:])
+		if err != nil {
+			return nil, false, err
+		}
+		return []*Event{{Kind: EventKeepalive, LSN: pkm.ServerWALEnd}}, pkm.ReplyRequested, nil
+	case pglogrepl.XLogDataByteID:
+		xld, err := pglogrepl.ParseXLogData(data[1:])
+		if err != nil {
+			return nil, false, err
+		}
+		events, err := dec.decode(xld)
+		return events, false, err
+	}
+	return nil, false, nil
+}
+
+// streamSource - events of a started logical replication connection.
+// Standby status is sent every standbyTimeout and when the server asks for it.
+type streamSource struct {
+	conn     *pgconn.PgConn
+	dec      streamDecoder
+	status   func() error
+	deadline time.Time
+	reply    bool
+	// events - decoded and not returned yet
+	events []*Event
+}
+
+const standbyTimeout = time.Second * 10
+
+func newStreamSource(conn *pgconn.PgConn, dec streamDecoder, status func() error) *streamSource {
+	return &streamSource{
+		conn:     conn,
+		dec:      dec,
+		status:   status,
+		deadline: time.Now().Add(standbyTimeout),
+	}
+}
+
+// Next - Source. An error means the connection must be restarted.
+func (s *streamSource) Next(ctx context.Context) (*Event, error) {
+	for {
+		if len(s.events) > 0 {
+			ev := s.events[0]
+			s.events = s.events[1:]
+			return ev, nil
+		}
+		// the reply is sent after the keepalive has been applied
+		if s.reply || time.Now().After(s.deadline) {
+			err := s.status()
+			if err != nil {
+				return nil, err
+			}
+			s.reply = false
+			s.deadline = time.Now().Add(standbyTimeout)
+		}
+
+		rctx, cancel := context.WithDeadline(ctx, s.deadline)
+		rawMsg, err := s.conn.ReceiveMessage(rctx)
+		cancel()
+		if err != nil {
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		switch msg := rawMsg.(type) {
+		case *pgproto3.ErrorResponse:
+			// the slot may have been invalidated
+			return nil, fmt.Errorf("received Postgres WAL error: %+v", msg)
+		case *pgproto3.CopyData:
+			if capt != nil {
+				err = capt.write(time.Now(), msg.Data)
+				if err != nil {
+					glog.Error(err)
+				}
+			}
+			events, reply, err := decodeCopyData(s.dec, msg.Data)
+			if err != nil {
+				glog.Error(err)
+				continue
+			}
+			s.reply = s.reply || reply
+			s.events = events
+		default:
+			glog.Warningf("replication received unexpected message: %T", rawMsg)
+		}
+	}
+}
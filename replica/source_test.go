@@ -0,0 +1,204 @@
+package replica
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// itemsRelation - relation (id int8 key, name text, qty int8) of the namespace
+func itemsRelation(id uint32, namespace string) *Event {
+	return &Event{Kind: EventRelation, Relation: &Relation{
+		ID:        id,
+		Namespace: namespace,
+		Name:      "items",
+		Columns: []Column{
+			{Name: "id", Type: 20, Key: true},
+			{Name: "name", Type: 25},
+			{Name: "qty", Type: 20},
+		},
+	}}
+}
+
+func keyRow(vals ...driver.Value) []driver.Value { return vals }
+
+func insertEvent(rel uint32, vals ...driver.Value) *Event {
+	return &Event{Kind: EventInsert, RelationID: rel, New: vals}
+}
+
+func updateEvent(rel uint32, old []driver.Value, vals ...driver.Value) *Event {
+	return &Event{Kind: EventUpdate, RelationID: rel, Old: old, New: vals}
+}
+
+func deleteEvent(rel uint32, old ...driver.Value) *Event {
+	return &Event{Kind: EventDelete, RelationID: rel, Old: old}
+}
+
+func txEvents(lsn pglogrepl.LSN, events ...*Event) []*Event {
+	list := append([]*Event{{Kind: EventBegin}}, events...)
+	return append(list, &Event{Kind: EventCommit, LSN: lsn})
+}
+
+// cachedRows - rows of the sqlite table ordered by the first column, values printed with %v separated by spaces
+func cachedRows(t *testing.T, table string) []string {
+	t.Helper()
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM %s ORDER BY 1;", quoteIdent(table)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var list []string
+	for rows.Next() {
+		vals, err := rows.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, strings.TrimSuffix(fmt.Sprintln(vals...), "\n"))
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+// runEvents - applies the events to sqlite with RunSource, with no events it only opens the database
+func runEvents(t *testing.T, cfg *Config, events ...*Event) {
+	t.Helper()
+	src := NewMemorySource(len(events))
+	src.Push(events...)
+	src.Close()
+	err := RunSource(src, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sourceRuns - subtests run so far, the sqlite database and the applied position outlive a test
+var sourceRuns int
+
+func TestRunSource(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// events - of the relation items in namespace ns, transaction ends are base+10, base+20
+		events func(ns string, base pglogrepl.LSN) []*Event
+		// rows - of the table <ns>_items
+		rows []string
+	}{
+		{
+			name: "insert",
+			events: func(ns string, base pglogrepl.LSN) []*Event {
+				return append([]*Event{itemsRelation(1, ns)}, txEvents(base+10,
+					insertEvent(1, int64(1), "a", int64(5)),
+					insertEvent(1, int64(2), "b", nil),
+				)...)
+			},
+			rows: []string{"1 a 5", "2 b <nil>"},
+		},
+		{
+			name: "update",
+			events: func(ns string, base pglogrepl.LSN) []*Event {
+				list := append([]*Event{itemsRelation(1, ns)}, txEvents(base+10,
+					insertEvent(1, int64(1), "a", int64(5)),
+					insertEvent(1, int64(2), "b", int64(6)),
+				)...)
+				return append(list, txEvents(base+20,
+					updateEvent(1, nil, int64(1), "a2", int64(7)),
+					updateEvent(1, nil, int64(1), "a3", int64(8)),
+					updateEvent(1, nil, int64(2), "b2", int64(6)),
+					updateEvent(1, nil, int64(1), "a4", int64(9)),
+				)...)
+			},
+			rows: []string{"1 a4 9", "2 b2 6"},
+		},
+		{
+			name: "delete",
+			events: func(ns string, base pglogrepl.LSN) []*Event {
+				list := append([]*Event{itemsRelation(1, ns)}, txEvents(base+10,
+					insertEvent(1, int64(1), "a", int64(5)),
+					insertEvent(1, int64(2), "b", int64(6)),
+					insertEvent(1, int64(3), "c", int64(7)),
+				)...)
+				return append(list, txEvents(base+20,
+					deleteEvent(1, int64(2), nil, nil),
+					updateEvent(1, nil, int64(3), "c2", int64(8)),
+					deleteEvent(1, int64(3), nil, nil),
+				)...)
+			},
+			rows: []string{"1 a 5"},
+		},
+		{
+			name: "truncate",
+			events: func(ns string, base pglogrepl.LSN) []*Event {
+				list := append([]*Event{itemsRelation(1, ns)}, txEvents(base+10,
+					insertEvent(1, int64(1), "a", int64(5)),
+					insertEvent(1, int64(2), "b", int64(6)),
+				)...)
+				return append(list, txEvents(base+20,
+					&Event{Kind: EventTruncate, RelationIDs: []uint32{1}},
+					insertEvent(1, int64(3), "c", int64(7)),
+				)...)
+			},
+			rows: []string{"3 c 7"},
+		},
+		{
+			name: "key change",
+			events: func(ns string, base pglogrepl.LSN) []*Event {
+				list := append([]*Event{itemsRelation(1, ns)}, txEvents(base+10,
+					insertEvent(1, int64(1), "a", int64(5)),
+					insertEvent(1, int64(2), "b", int64(6)),
+				)...)
+				return append(list, txEvents(base+20,
+					updateEvent(1, keyRow(int64(1), nil, nil), int64(10), "a", int64(5)),
+					updateEvent(1, nil, int64(10), "a2", int64(5)),
+					updateEvent(1, keyRow(int64(2), nil, nil), int64(20), "b2", int64(6)),
+					insertEvent(1, int64(1), "new", int64(1)),
+				)...)
+			},
+			rows: []string{"1 new 1", "10 a2 5", "20 b2 6"},
+		},
+		{
+			name: "relation change",
+			events: func(ns string, base pglogrepl.LSN) []*Event {
+				list := append([]*Event{itemsRelation(1, ns)}, txEvents(base+10,
+					insertEvent(1, int64(1), "a", int64(5)),
+					updateEvent(1, nil, int64(1), "a2", int64(6)),
+				)...)
+				// the columns are reordered and qty is dropped
+				list = append(list, &Event{Kind: EventRelation, Relation: &Relation{
+					ID:        1,
+					Namespace: ns,
+					Name:      "items",
+					Columns: []Column{
+						{Name: "name", Type: 25},
+						{Name: "id", Type: 20, Key: true},
+					},
+				}})
+				return append(list, txEvents(base+20,
+					insertEvent(1, "b", int64(2)),
+					updateEvent(1, nil, "a3", int64(1)),
+				)...)
+			},
+			rows: []string{"1 a3 6", "2 b <nil>"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// every run has its own table, applied only moves forward
+			sourceRuns++
+			ns := fmt.Sprintf("run%d", sourceRuns)
+			events := tc.events(ns, pglogrepl.LSN(1000*sourceRuns))
+			runEvents(t, nil, events...)
+			rows := cachedRows(t, ns+"_items")
+			if !reflect.DeepEqual(rows, tc.rows) {
+				t.Errorf("rows %q, want %q", rows, tc.rows)
+			}
+			last := events[len(events)-1].LSN
+			if got := r.applied.get(); got != last {
+				t.Errorf("applied %s, want %s", got, last)
+			}
+		})
+	}
+}
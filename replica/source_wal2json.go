@@ -0,0 +1,257 @@
+package replica
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// wal2jsonColumn - column of a format-version 2 change
+type wal2jsonColumn struct {
+	Name  string          `json:"name"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// wal2jsonChange - format-version 2 message, one per change
+type wal2jsonChange struct {
+	Action   string           `json:"action"`
+	LSN      string           `json:"lsn"`
+	NextLSN  string           `json:"nextlsn"`
+	Schema   string           `json:"schema"`
+	Table    string           `json:"table"`
+	Columns  []wal2jsonColumn `json:"columns"`
+	Identity []wal2jsonColumn `json:"identity"`
+	PK       []wal2jsonColumn `json:"pk"`
+}
+
+// wal2jsonDecoder - turns wal2json format-version 2 messages into events.
+// wal2json sends no relation messages, a relation event is made up
+// when a table is seen for the first time or its columns change.
+type wal2jsonDecoder struct {
+	ids  map[pgRelation]uint32
+	rels map[uint32]*Relation
+}
+
+func newWal2jsonDecoder() *wal2jsonDecoder {
+	return &wal2jsonDecoder{
+		ids:  make(map[pgRelation]uint32),
+		rels: make(map[uint32]*Relation),
+	}
+}
+
+// wal2jsonArgs - plugin arguments, add-tables limits the stream to the cached tables
+func wal2jsonArgs(list []pgRelation) []string {
+	args := []string{
+		"\"format-version\" '2'",
+		"\"include-lsn\" '1'",
+		"\"include-pk\" '1'",
+		"\"include-types\" '1'",
+		"\"include-typmod\" '0'",
+	}
+	if len(list) > 0 {
+		names := make([]string, len(list))
+		for i, rel := range list {
+			names[i] = wal2jsonEscape(rel.shema) + "." + wal2jsonEscape(rel.table)
+		}
+		args = append(args, "\"add-tables\" "+optionLiteral(strings.Join(names, ",")))
+	}
+	return args
+}
+
+// wal2jsonEscape - space, quote, comma, period and asterisk are escaped in add-tables
+func wal2jsonEscape(name string) string {
+	var b strings.Builder
+	for _, c := range name {
+		switch c {
+		case ' ', '\'', ',', '.', '*', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// decode - streamDecoder
+func (d *wal2jsonDecoder) decode(xld pglogrepl.XLogData) ([]*Event, error) {
+	var m wal2jsonChange
+	err := json.Unmarshal(xld.WALData, &m)
+	if err != nil {
+		return nil, fmt.Errorf("wal2json err: %v", err)
+	}
+	lsn := xld.WALStart + pglogrepl.LSN(len(xld.WALData))
+	switch m.Action {
+	case "B":
+		return []*Event{{Kind: EventBegin, LSN: lsn}}, nil
+
+	case "C":
+		// nextlsn is the end of the commit record
+		for _, v := range []string{m.NextLSN, m.LSN} {
+			if v == "" {
+				continue
+			}
+			commit, err := pglogrepl.ParseLSN(v)
+			if err != nil {
+				return nil, err
+			}
+			if commit > lsn {
+				lsn = commit
+			}
+			break
+		}
+		return []*Event{{Kind: EventCommit, LSN: lsn}}, nil
+
+	case "I", "U", "D":
+		var events []*Event
+		rel, changed := d.relation(&m)
+		if changed {
+			events = append(events, &Event{Kind: EventRelation, LSN: lsn, Relation: rel})
+		}
+		ev := &Event{RelationID: rel.ID, LSN: lsn}
+		var err error
+		switch m.Action {
+		case "I":
+			ev.Kind = EventInsert
+			ev.New, err = d.values(rel, m.Columns)
+		case "U":
+			ev.Kind = EventUpdate
+			ev.New, err = d.values(rel, m.Columns)
+			if err == nil && len(m.Identity) > 0 {
+				ev.Old, err = d.values(rel, m.Identity)
+			}
+		case "D":
+			ev.Kind = EventDelete
+			ev.Old, err = d.values(rel, m.Identity)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("wal2json %s.%s: %v", m.Schema, m.Table, err)
+		}
+		return append(events, ev), nil
+
+	case "T":
+		var events []*Event
+		key := pgRelation{m.Schema, m.Table}
+		id, ok := d.ids[key]
+		if !ok {
+			// the columns are not known yet, the relation only truncates
+			rel, _ := d.relation(&m)
+			id = rel.ID
+			events = append(events, &Event{Kind: EventRelation, LSN: lsn, Relation: rel})
+		}
+		return append(events, &Event{Kind: EventTruncate, LSN: lsn, RelationIDs: []uint32{id}}), nil
+	}
+	// M - logical decoding messages
+	return nil, nil
+}
+
+// relation - relation of the change, changed if it is new or its columns differ from the last change
+func (d *wal2jsonDecoder) relation(m *wal2jsonChange) (*Relation, bool) {
+	key := pgRelation{m.Schema, m.Table}
+	id, ok := d.ids[key]
+	if !ok {
+		id = uint32(len(d.ids) + 1)
+		d.ids[key] = id
+	}
+	prev := d.rels[id]
+
+	rel := &Relation{ID: id, Namespace: m.Schema, Name: m.Table}
+	cols := m.Columns
+	if len(cols) == 0 && prev != nil {
+		// a delete only has the identity
+		return prev, false
+	}
+	if len(cols) == 0 {
+		cols = m.Identity
+	}
+	keys := m.PK
+	if len(keys) == 0 {
+		keys = m.Identity
+	}
+	for _, c := range cols {
+		col := Column{Name: c.Name, Type: typeOID(c.Type)}
+		for _, k := range keys {
+			if k.Name == c.Name {
+				col.Key = true
+				break
+			}
+		}
+		rel.Columns = append(rel.Columns, col)
+	}
+	if prev != nil && sameColumns(prev.Columns, rel.Columns) {
+		return prev, false
+	}
+	d.rels[id] = rel
+	return rel, true
+}
+
+func sameColumns(a, b []Column) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// values - row in the relation column order, columns missing in list are nil
+func (d *wal2jsonDecoder) values(rel *Relation, list []wal2jsonColumn) ([]driver.Value, error) {
+	vals := make([]driver.Value, len(rel.Columns))
+	for _, c := range list {
+		for i, col := range rel.Columns {
+			if col.Name != c.Name {
+				continue
+			}
+			v, err := jsonValue(col.Type, c.Value)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %v", c.Name, err)
+			}
+			vals[i] = v
+			break
+		}
+	}
+	return vals, nil
+}
+
+// sqlTypeNames - format_type names of the pgtype names
+var sqlTypeNames = map[string]string{
+	"smallint":                    "int2",
+	"integer":                     "int4",
+	"bigint":                      "int8",
+	"boolean":                     "bool",
+	"real":                        "float4",
+	"double precision":            "float8",
+	"character":                   "bpchar",
+	"character varying":           "varchar",
+	"bit varying":                 "varbit",
+	"time without time zone":      "time",
+	"time with time zone":         "timetz",
+	"timestamp without time zone": "timestamp",
+	"timestamp with time zone":    "timestamptz",
+}
+
+var typmod = regexp.MustCompile(`\([0-9, ]*\)`)
+
+// typeOID - oid of a wal2json type name, unknown types are read as text
+func typeOID(name string) uint32 {
+	name = strings.Join(strings.Fields(typmod.ReplaceAllString(name, "")), " ")
+	array := strings.HasSuffix(name, "[]")
+	name = strings.TrimSuffix(name, "[]")
+	if v, ok := sqlTypeNames[name]; ok {
+		name = v
+	}
+	if array {
+		name = "_" + name
+	}
+	if dt, ok := mi.TypeForName(name); ok {
+		return dt.OID
+	}
+	return pgtype.TextOID
+}
@@ -0,0 +1,183 @@
+package replica
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// itemsColumns - columns of public.items in the wal2json messages
+const itemsColumns = `{"name":"id","type":"bigint","value":1},{"name":"name","type":"text","value":"a"},{"name":"qty","type":"integer","value":5}`
+
+func TestWal2jsonDecode(t *testing.T) {
+	items := &Relation{ID: 1, Namespace: "public", Name: "items", Columns: []Column{
+		{Name: "id", Type: pgtype.Int8OID, Key: true},
+		{Name: "name", Type: pgtype.TextOID},
+		{Name: "qty", Type: pgtype.Int4OID},
+	}}
+	// the note column is added
+	items2 := &Relation{ID: 1, Namespace: "public", Name: "items", Columns: append(append([]Column(nil), items.Columns...),
+		Column{Name: "note", Type: pgtype.VarcharOID},
+	)}
+	keyOnly := keyRow(int64(1), nil, nil)
+
+	d := newWal2jsonDecoder()
+	for i, tc := range []struct {
+		name string
+		msg  string
+		// want - LSN 0 is the end of the message
+		want []*Event
+	}{
+		{"begin", `{"action":"B"}`, []*Event{{Kind: EventBegin}}},
+		{
+			"first insert",
+			`{"action":"I","schema":"public","table":"items","columns":[` + itemsColumns + `],"pk":[{"name":"id","type":"bigint"}]}`,
+			[]*Event{
+				{Kind: EventRelation, Relation: items},
+				{Kind: EventInsert, RelationID: 1, New: keyRow(int64(1), "a", int64(5))},
+			},
+		},
+		{
+			"update",
+			`{"action":"U","schema":"public","table":"items",` +
+				`"columns":[{"name":"id","type":"bigint","value":2},{"name":"name","type":"text","value":null},{"name":"qty","type":"integer","value":6}],` +
+				`"identity":[{"name":"id","type":"bigint","value":1}],"pk":[{"name":"id","type":"bigint"}]}`,
+			[]*Event{{Kind: EventUpdate, RelationID: 1, Old: keyOnly, New: keyRow(int64(2), nil, int64(6))}},
+		},
+		{
+			"update without identity",
+			`{"action":"U","schema":"public","table":"items","columns":[` + itemsColumns + `],"pk":[{"name":"id","type":"bigint"}]}`,
+			[]*Event{{Kind: EventUpdate, RelationID: 1, New: keyRow(int64(1), "a", int64(5))}},
+		},
+		{
+			"delete",
+			`{"action":"D","schema":"public","table":"items","identity":[{"name":"id","type":"bigint","value":1}],"pk":[{"name":"id","type":"bigint"}]}`,
+			[]*Event{{Kind: EventDelete, RelationID: 1, Old: keyOnly}},
+		},
+		{
+			"column added",
+			`{"action":"I","schema":"public","table":"items","columns":[` + itemsColumns +
+				`,{"name":"note","type":"character varying(20)","value":"x"}],"pk":[{"name":"id","type":"bigint"}]}`,
+			[]*Event{
+				{Kind: EventRelation, Relation: items2},
+				{Kind: EventInsert, RelationID: 1, New: keyRow(int64(1), "a", int64(5), "x")},
+			},
+		},
+		{
+			"delete of a new table",
+			`{"action":"D","schema":"s","table":"other","identity":[{"name":"k","type":"text","value":"x"}]}`,
+			[]*Event{
+				{Kind: EventRelation, Relation: &Relation{ID: 2, Namespace: "s", Name: "other", Columns: []Column{
+					{Name: "k", Type: pgtype.TextOID, Key: true},
+				}}},
+				{Kind: EventDelete, RelationID: 2, Old: keyRow("x")},
+			},
+		},
+		{
+			"truncate of a new table",
+			`{"action":"T","schema":"s","table":"empty"}`,
+			[]*Event{
+				{Kind: EventRelation, Relation: &Relation{ID: 3, Namespace: "s", Name: "empty"}},
+				{Kind: EventTruncate, RelationIDs: []uint32{3}},
+			},
+		},
+		{"truncate", `{"action":"T","schema":"public","table":"items"}`, []*Event{{Kind: EventTruncate, RelationIDs: []uint32{1}}}},
+		{"message", `{"action":"M","transactional":false,"prefix":"p","content":"c"}`, nil},
+		{"commit", `{"action":"C","lsn":"0/7000","nextlsn":"1/10"}`, []*Event{{Kind: EventCommit, LSN: 0x100000010}}},
+		{"commit before the message end", `{"action":"C","lsn":"0/10"}`, []*Event{{Kind: EventCommit}}},
+	} {
+		start := pglogrepl.LSN(0x1000 * (i + 1))
+		end := start + pglogrepl.LSN(len(tc.msg))
+		for _, ev := range tc.want {
+			if ev.LSN == 0 {
+				ev.LSN = end
+			}
+		}
+		events, err := d.decode(pglogrepl.XLogData{WALStart: start, WALData: []byte(tc.msg)})
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(events, tc.want) {
+			t.Errorf("%s: events", tc.name)
+			for _, ev := range events {
+				t.Logf("got  %+v %+v", ev, ev.Relation)
+			}
+			for _, ev := range tc.want {
+				t.Logf("want %+v %+v", ev, ev.Relation)
+			}
+		}
+	}
+
+	for _, msg := range []string{
+		`{"action":`,
+		`{"action":"I","schema":"public","table":"items","columns":[{"name":"id","type":"bigint","value":"x"}]}`,
+		`{"action":"C","nextlsn":"bad"}`,
+	} {
+		_, err := d.decode(pglogrepl.XLogData{WALData: []byte(msg)})
+		if err == nil {
+			t.Errorf("%s: error expected", msg)
+		}
+	}
+}
+
+func TestTypeOID(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		oid  uint32
+	}{
+		{"bigint", pgtype.Int8OID},
+		{"integer", pgtype.Int4OID},
+		{"text", pgtype.TextOID},
+		{"boolean", pgtype.BoolOID},
+		{"double precision", pgtype.Float8OID},
+		{"character varying(20)", pgtype.VarcharOID},
+		{"numeric(10, 2)", pgtype.NumericOID},
+		{"timestamp(3) with time zone", pgtype.TimestamptzOID},
+		{"timestamp without time zone", pgtype.TimestampOID},
+		{"integer[]", pgtype.Int4ArrayOID},
+		{"character varying(5)[]", pgtype.VarcharArrayOID},
+		{"uuid", pgtype.UUIDOID},
+		{"jsonb", pgtype.JSONBOID},
+		// user types are read as text
+		{"mood", pgtype.TextOID},
+	} {
+		if got := typeOID(tc.name); got != tc.oid {
+			t.Errorf("typeOID(%q) = %d, want %d", tc.name, got, tc.oid)
+		}
+	}
+}
+
+func TestWal2jsonArgs(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"users", "users"},
+		{"my.table", `my\.table`},
+		{"a b,c*", `a\ b\,c\*`},
+		{"it's", `it\'s`},
+		{`a\b`, `a\\b`},
+	} {
+		if got := wal2jsonEscape(tc.in); got != tc.want {
+			t.Errorf("wal2jsonEscape(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+
+	base := []string{
+		`"format-version" '2'`,
+		`"include-lsn" '1'`,
+		`"include-pk" '1'`,
+		`"include-types" '1'`,
+		`"include-typmod" '0'`,
+	}
+	if got := wal2jsonArgs(nil); !reflect.DeepEqual(got, base) {
+		t.Errorf("wal2jsonArgs(nil) = %q", got)
+	}
+	got := wal2jsonArgs([]pgRelation{{"public", "users"}, {"My Schema", "it's.x"}})
+	want := append(base, `"add-tables" 'public.users,My\ Schema.it\''s\.x'`)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wal2jsonArgs = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,72 @@
+package replica
+
+import (
+	"sort"
+	"time"
+)
+
+// Status -
+type Status struct {
+	// ActiveHost - address of the server the replication is connected to
+	ActiveHost string
+	// ReceivedLSN, AppliedLSN, FlushedLSN - WAL positions, empty in trigger capture mode
+	ReceivedLSN string
+	AppliedLSN  string
+	FlushedLSN  string
+	// ChangelogID - id of the last changelog row applied in trigger capture mode
+	ChangelogID int64
+	Tables      []TableStatus
+	// Loads - chunked initial loads in progress
+	Loads []LoadProgress
+}
+
+// TableStatus -
+type TableStatus struct {
+	Name   string
+	Target string
+	// Verify - last verification result, nil if the table was not verified yet
+	Verify *VerifyResult
+	// LastRefresh - start of the last load from pg, zero if the rows were not loaded
+	LastRefresh time.Time
+	// NextRefresh - zero unless the table is in refresh mode
+	NextRefresh time.Time
+	// RefreshErr - error of the last refresh
+	RefreshErr string
+}
+
+// GetStatus - replication positions and the state of every cached table
+func GetStatus() *Status {
+	mx.Lock()
+	defer mx.Unlock()
+
+	st := &Status{ActiveHost: r.host}
+	if captureMode == captureTrigger {
+		// the trigger source reports changelog ids as positions
+		st.ChangelogID = int64(r.applied.get())
+	} else {
+		st.ReceivedLSN = r.received.String()
+		st.AppliedLSN = r.applied.get().String()
+		st.FlushedLSN = r.flushed.String()
+	}
+	for target, opt := range tables {
+		ts := TableStatus{
+			Name:   opt.TableName,
+			Target: target,
+			Verify: verifies[target],
+		}
+		if rs := refreshes[target]; rs != nil {
+			ts.LastRefresh, ts.NextRefresh, ts.RefreshErr = rs.last, rs.next, rs.err
+		}
+		st.Tables = append(st.Tables, ts)
+	}
+	sort.Slice(st.Tables, func(i, j int) bool {
+		return st.Tables[i].Target < st.Tables[j].Target
+	})
+	for _, l := range loads {
+		st.Loads = append(st.Loads, l.progress)
+	}
+	sort.Slice(st.Loads, func(i, j int) bool {
+		return st.Loads[i].Target < st.Loads[j].Target
+	})
+	return st
+}
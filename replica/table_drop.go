@@ -1,33 +1,46 @@
 package replica
 
-import (
-	"net/url"
-	"strings"
-
-	"github.com/jackc/pgx/v5/pgconn"
-)
-
 // TableDrop -
 func TableDrop(name string) error {
-	u, err := url.Parse(r.pgURL)
+	conn, err := pgConnect()
 	if err != nil {
 		return err
 	}
-	param := url.Values{}
-	param.Add("sslmode", "require")
-	param.Add("application_name", "redispg_copy")
-	u.RawQuery = param.Encode()
+	defer conn.Close(ctx)
 
-	conn, err := pgconn.Connect(ctx, u.String())
+	opt := &AddOptions{TableName: name}
+	err = opt.parse()
 	if err != nil {
 		return err
 	}
-	defer conn.Close(ctx)
+	if cached, err := findTable(name); err == nil {
+		opt = cached
+	}
 
-	_, err = conn.Exec(ctx, "ALTER PUBLICATION "+slotName+" DROP TABLE "+name).ReadAll()
-	if err != nil {
-		return err
+	if opt.published == nil && !opt.refreshMode() {
+		opt.published = []pgRelation{{opt.shema, opt.table}}
+	}
+	if captureMode == captureTrigger {
+		err = dropTriggers(conn, opt.published)
+		if err != nil {
+			return err
+		}
+	}
+	for _, rel := range opt.published {
+		if !managedPublication() {
+			break
+		}
+		_, err = conn.Exec(ctx, "ALTER PUBLICATION "+quoteIdent(publication())+" DROP TABLE "+quoteTable(rel.shema, rel.table)).ReadAll()
+		if err != nil {
+			return err
+		}
 	}
-	err = db.Exec("DROP TABLE IF EXISTS " + strings.ReplaceAll(name, ".", "_") + ";")
+	mx.Lock()
+	delete(tables, opt.tableName())
+	delete(refreshes, opt.tableName())
+	r.untarget(opt)
+	r.restartStream()
+	err = db.Exec("DROP TABLE IF EXISTS " + quoteTarget(opt.tableName()) + ";")
+	mx.Unlock()
 	return err
 }
@@ -2,128 +2,433 @@ package replica
 
 import (
 	"fmt"
-	"net/url"
 	"strings"
+	"time"
 
+	"github.com/bendersilver/glog"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+// ExistsMode - TableAdd behaviour for a table that is already cached
+type ExistsMode int
+
+const (
+	// ExistsKeep - keep the existing cache
+	ExistsKeep ExistsMode = iota
+	// ExistsRefresh - reload the existing cache from a snapshot
+	ExistsRefresh
+	// ExistsError - fail with *TableExistsError
+	ExistsError
+)
+
+// TableExistsError -
+type TableExistsError struct {
+	TableName string
+}
+
+// Error -
+func (e *TableExistsError) Error() string {
+	return fmt.Sprintf("table %s already exists", e.TableName)
+}
+
 // AddOptions -
 type AddOptions struct {
 	TableName string
 	InitData  bool
 	Query     string
-	shema     string
-	table     string
+	IfExists  ExistsMode
+	// Target - sqlite table name, `<shema>_<table_name>` by default.
+	// `<schema>.<name>` puts the table into the attached in-memory database schema.
+	Target string
+	// Columns - cached columns, all if empty. The key column must be one of them.
+	Columns []string
+	// AttachSchema - default Target is `<shema>.<table_name>`,
+	// so queries keep the pg names
+	AttachSchema bool
+	// Transform - Go hook run on every decoded row, also on the old key row
+	// of updates and deletes where the other columns may be nil
+	Transform TransformFunc
+	// Expressions - sqlite expressions stored instead of the column values,
+	// e.g. {"email": "lower(email)"}
+	Expressions map[string]string
+	// Computed - extra sqlite columns calculated from the row
+	Computed []ComputedColumn
+	// IgnoreTruncate - keep the cached rows when the pg table is truncated
+	IgnoreTruncate bool
+	// ChunkSize - rows per chunk of a resumable initial load by key ranges,
+	// 0 loads the table with one COPY. Not used with Query.
+	ChunkSize int
+	// Refresh - the table is not streamed but reloaded every Refresh into a shadow copy,
+	// for views, foreign tables and tables without a replica identity
+	Refresh time.Duration
+	// RefreshCron - refresh schedule `<minute> <hour> <day> <month> <weekday>` instead of Refresh
+	RefreshCron string
+	cron        *cronSchedule
+	shema       string
+	table       string
+	target      string
+	// partitioned - the pg table is a partitioned parent, leaves are streamed for it
+	partitioned bool
+	leaves      []pgRelation
+	// published - relations of the table added to the publication
+	published []pgRelation
+}
+
+// parse - pg schema and table of TableName and the sqlite table name
+func (o *AddOptions) parse() (err error) {
+	o.shema, o.table, err = parseTableName(o.TableName)
+	if err != nil {
+		return err
+	}
+	switch {
+	case o.Target != "":
+		parts, err := splitIdent(o.Target, false)
+		if err != nil {
+			return err
+		}
+		switch len(parts) {
+		case 1:
+			o.target, err = targetName("main", parts[0])
+		case 2:
+			o.target, err = targetName(parts[0], parts[1])
+		default:
+			err = fmt.Errorf("wrong format target %q. Target format `[<schema>.]<name>`", o.Target)
+		}
+		return err
+	case o.AttachSchema:
+		o.target, err = targetName(o.shema, o.table)
+	default:
+		o.target, err = targetName("main", o.shema+"_"+o.table)
+	}
+	return err
 }
 
 func (o *AddOptions) tableName() string {
-	return fmt.Sprintf("%s_%s", o.shema, o.table)
+	return o.target
 }
 
-// TableAdd -
-func TableAdd(opt *AddOptions) error {
-	u, err := url.Parse(r.pgURL)
+// source - query of the cached rows
+func (o *AddOptions) source() string {
+	if o.Query != "" {
+		return o.Query
+	}
+	cols := "*"
+	if len(o.Columns) > 0 {
+		names := make([]string, len(o.Columns))
+		for i, c := range o.Columns {
+			names[i] = quoteIdent(c)
+		}
+		cols = strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("SELECT %s FROM %s", cols, quoteTable(o.shema, o.table))
+}
+
+// cachedTable - options of the cached pg table or partition, mx must be held
+func cachedTable(shema, table string) *AddOptions {
+	for _, opt := range tables {
+		if opt.matches(shema, table) {
+			return opt
+		}
+	}
+	return nil
+}
+
+// findTable - options of the cached table `<shema>.<table_name>`
+func findTable(name string) (*AddOptions, error) {
+	shema, table, err := parseTableName(name)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	opt := cachedTable(shema, table)
+	if opt == nil {
+		return nil, fmt.Errorf("table %s is not cached", name)
 	}
-	param := url.Values{}
-	param.Add("sslmode", "require")
-	param.Add("application_name", slotName)
-	u.RawQuery = param.Encode()
+	return opt, nil
+}
 
-	conn, err := pgconn.Connect(ctx, u.String())
+// splitTarget - sqlite schema and table name
+func splitTarget(target string) (schema, name string) {
+	if i := strings.IndexByte(target, '.'); i >= 0 {
+		return target[:i], target[i+1:]
+	}
+	return "main", target
+}
+
+// TableAdd -
+func TableAdd(opt *AddOptions) error {
+	conn, err := pgConnect()
 	if err != nil {
 		return fmt.Errorf("pg connerct err: %v", err)
 	}
 	defer conn.Close(ctx)
-	args := strings.Split(opt.TableName, ".")
-	if len(args) != 2 {
-		return fmt.Errorf("wrong format table. TableName format `<shema>.<table_name>`")
+	err = opt.parse()
+	if err != nil {
+		return err
 	}
-	opt.shema = args[0]
-	opt.table = args[1]
-
-	res, err := conn.Exec(ctx, fmt.Sprintf(`
-		SELECT *
-		FROM pg_catalog.pg_publication_tables
-		WHERE pubname = '%s'
-			AND schemaname = '%s'
-			AND tablename = '%s';
-		`, slotName, opt.shema, opt.table)).ReadAll()
+	err = opt.checkTransform()
 	if err != nil {
-		return fmt.Errorf("pg get pg_publication_tables err: %v", err)
+		return err
+	}
+	err = opt.checkRefresh()
+	if err != nil {
+		return err
+	}
+	err = opt.checkChunks()
+	if err != nil {
+		return err
+	}
+
+	mx.Lock()
+	cached := cachedTable(opt.shema, opt.table)
+	other, used := tables[opt.tableName()]
+	mx.Unlock()
+	exists := cached != nil
+	if exists && opt.IfExists == ExistsError {
+		return &TableExistsError{TableName: opt.TableName}
+	}
+	if used && other != cached {
+		return fmt.Errorf("sqlite table %s is used by %s", opt.tableName(), other.TableName)
 	}
-	if len(res) > 0 && res[0].Rows != nil {
-		err = TableDrop(opt.TableName)
+	if exists && cached.tableName() != opt.tableName() {
+		return fmt.Errorf("table %s is cached as %s", opt.TableName, cached.tableName())
+	}
+
+	var added []pgRelation
+	if opt.refreshMode() {
+		// reloaded from the query, nothing is streamed
+		opt.partitioned, opt.leaves, opt.published = false, nil, nil
+		startRefresher()
+	} else {
+		err = opt.partitions(conn)
+		if err != nil {
+			return err
+		}
+		added, err = publish(conn, opt)
 		if err != nil {
-			return fmt.Errorf("pg drop publication err: %v", err)
+			if !exists {
+				rollback(conn, opt, added)
+			}
+			return err
 		}
+	}
+
+	if exists {
+		if opt.IfExists != ExistsRefresh {
+			return nil
+		}
+		err = reload(conn, opt)
+		if err != nil {
+			return err
+		}
+		mx.Lock()
+		tables[opt.tableName()] = opt
+		r.retarget(opt)
+		r.restartStream()
+		mx.Unlock()
+		return nil
+	}
+
+	if opt.ChunkSize > 0 && opt.InitData && !opt.refreshMode() {
+		err = addChunked(conn, opt)
 	} else {
+		err = addTable(conn, opt)
+	}
+	if err != nil {
+		rollback(conn, opt, added)
+		return err
+	}
+	return nil
+}
+
+// addTable - loads a new table into a staging copy and renames it into place,
+// readers see either no table or all of its rows. The stream waits for the load.
+func addTable(conn *pgconn.PgConn, opt *AddOptions) error {
+	target := opt.tableName()
+	staging := target + "__staging"
+
+	mx.Lock()
+	defer mx.Unlock()
+	r.flush()
+
+	// leftover of a failed load
+	err := db.Exec("DROP TABLE IF EXISTS " + quoteTarget(staging) + ";")
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = load(conn, opt, staging)
+	if err == nil {
+		err = swap(staging, target)
+	}
+	if err != nil {
+		db.Exec("DROP TABLE IF EXISTS " + quoteTarget(staging) + ";")
+		return err
+	}
+	if opt.InitData {
+		loaded(opt, start)
+	}
+	tables[target] = opt
+	r.retarget(opt)
+	r.restartStream()
+	return nil
+}
+
+// rollback - removes the publication entries or triggers added for a new table that failed to load
+func rollback(conn *pgconn.PgConn, opt *AddOptions, added []pgRelation) {
+	var err error
+	switch {
+	case len(added) == 0:
+		return
+	case captureMode == captureTrigger:
+		err = dropTriggers(conn, added)
+	default:
+		for _, rel := range added {
+			_, err = conn.Exec(ctx, fmt.Sprintf("ALTER PUBLICATION %s DROP TABLE %s;",
+				quoteIdent(publication()), quoteTable(rel.shema, rel.table))).ReadAll()
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		glog.Errorf("table %s rollback err: %v", opt.TableName, err)
+	}
+}
+
+// publish - adds the relations of the table to the publication, returns the ones it added.
+// An external publication must already publish them. wal2json has no publication,
+// the trigger mode installs the capture triggers instead.
+func publish(conn *pgconn.PgConn, opt *AddOptions) (added []pgRelation, err error) {
+	if captureMode == captureTrigger {
+		return installTriggers(conn, opt)
+	}
+	if plugin != pluginPgoutput {
+		return nil, nil
+	}
+	for _, rel := range opt.published {
+		if externalPublication {
+			res := conn.ExecParams(ctx, `
+				SELECT 1
+				FROM pg_catalog.pg_publication_tables
+				WHERE pubname = $1 AND schemaname = $2 AND tablename = $3;
+				`, [][]byte{[]byte(publication()), []byte(rel.shema), []byte(rel.table)}, nil, nil, nil).Read()
+			if res.Err != nil {
+				return added, fmt.Errorf("pg get pg_publication_tables err: %v", res.Err)
+			}
+			if len(res.Rows) == 0 {
+				return added, fmt.Errorf("table %s is not published by %s", quoteTable(rel.shema, rel.table), publication())
+			}
+			continue
+		}
+		res := conn.ExecParams(ctx, `
+			SELECT 1
+			FROM pg_catalog.pg_publication_rel pr
+			JOIN pg_catalog.pg_publication p ON p.oid = pr.prpubid
+			WHERE p.pubname = $1
+				AND pr.prrelid = $2::regclass;
+			`, [][]byte{[]byte(publication()), []byte(quoteTable(rel.shema, rel.table))}, nil, nil, nil).Read()
+		if res.Err != nil {
+			return added, fmt.Errorf("pg get pg_publication_rel err: %v", res.Err)
+		}
+		if len(res.Rows) > 0 {
+			continue
+		}
 		_, err = conn.Exec(ctx, fmt.Sprintf(`
 			ALTER PUBLICATION %s ADD TABLE %s;
-			`, slotName, opt.TableName)).ReadAll()
+			`, quoteIdent(publication()), quoteTable(rel.shema, rel.table))).ReadAll()
 		if err != nil {
-			return fmt.Errorf("alter publication err: %v", err)
+			return added, fmt.Errorf("alter publication err: %v", err)
 		}
+		added = append(added, rel)
 	}
+	return added, nil
+}
 
+// sqliteType - column type of the pg type
+func sqliteType(oid uint32) string {
+	switch oid {
+	case pgtype.BoolOID:
+		return "BOOLEAN"
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.TimestampOID, pgtype.TimestamptzOID, pgtype.DateOID:
+		return "INTEGER"
+	case pgtype.NumericOID, pgtype.Float4OID, pgtype.Float8OID:
+		return "REAL"
+	case pgtype.TextOID, pgtype.VarcharOID, pgtype.NameOID:
+		return "TEXT"
+	}
+	return "BLOB"
+}
+
+// load - creates sqlite table target and fills it from pg, mx must be held
+func load(conn *pgconn.PgConn, opt *AddOptions, target string) error {
+	t, err := createTable(conn, opt, target)
+	if err != nil {
+		return err
+	}
+	defer t.insert.Close()
+	return t.fill(conn)
+}
+
+// fill - copies the rows of the table if opt.InitData is set
+func (t *tmpTable) fill(conn *pgconn.PgConn) (err error) {
+	opt := t.opt
+	if !opt.InitData {
+		return nil
+	}
+	if opt.Query != "" || len(opt.Columns) > 0 || opt.partitioned || opt.refreshMode() {
+		// COPY TO doesn't read partitioned tables, views and foreign tables
+		err = t.copy(conn, "COPY ("+opt.source()+") TO STDOUT WITH BINARY;")
+	} else {
+		err = t.copy(conn, "COPY BINARY "+t.dbName+" TO STDOUT;")
+	}
+	if err != nil {
+		return fmt.Errorf("copy err: %v", err)
+	}
+	return nil
+}
+
+// createTable - creates the empty sqlite table target with the columns of the pg rows,
+// the insert of the returned table must be closed
+func createTable(conn *pgconn.PgConn, opt *AddOptions, target string) (*tmpTable, error) {
 	cmt, err := conn.Prepare(ctx,
-		opt.TableName,
-		fmt.Sprintf(`SELECT * FROM %s LIMIT 1;`, opt.TableName),
+		"",
+		opt.source(),
 		nil,
 	)
 	if err != nil {
-		return fmt.Errorf("pg prepare err: %v", err)
+		return nil, fmt.Errorf("pg prepare err: %v", err)
 	}
-	var t tmpTable
+	t := new(tmpTable)
 	t.field = cmt.Fields
-	t.dbName = opt.TableName
+	t.dbName = quoteTable(opt.shema, opt.table)
+
+	schema, _ := splitTarget(target)
+	err = db.Attach(schema)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite attach err: %v", err)
+	}
 
 	create := make([]string, len(cmt.Fields))
+	t.names = make([]string, len(cmt.Fields))
 	for i, f := range cmt.Fields {
-		create[i] = f.Name
-		switch f.DataTypeOID {
-		case pgtype.BoolOID:
-			create[i] += " BOOLEAN"
-		case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.TimestampOID, pgtype.TimestamptzOID, pgtype.DateOID:
-			create[i] += " INTEGER"
-		case pgtype.NumericOID, pgtype.Float4OID, pgtype.Float8OID:
-			create[i] += " REAL"
-		case pgtype.TextOID, pgtype.VarcharOID, pgtype.NameOID:
-			create[i] += " TEXT"
-		default:
-			create[i] += " BLOB"
-		}
-	}
-	err = db.Exec(fmt.Sprintf("CREATE TABLE %s (\n%s\n);", opt.tableName(), strings.Join(create, ",\n")))
-	if err != nil {
-		return fmt.Errorf("sqlite create table err: %v", err)
+		t.names[i] = f.Name
+		create[i] = quoteIdent(f.Name) + " " + sqliteType(f.DataTypeOID)
 	}
-	for i := range create {
-		create[i] = "?"
+	for _, c := range opt.Computed {
+		create = append(create, strings.TrimSpace(quoteIdent(c.Name)+" "+c.Type))
 	}
-
-	t.insert, err = db.Prepare(fmt.Sprintf("INSERT INTO %s VALUES (%s);", opt.tableName(), strings.Join(create, ", ")))
+	err = db.Exec(fmt.Sprintf("CREATE TABLE %s (\n%s\n);", quoteTarget(target), strings.Join(create, ",\n")))
 	if err != nil {
-		return fmt.Errorf("sqlite prepare err: %v", err)
+		return nil, fmt.Errorf("sqlite create table err: %v", err)
 	}
-	defer t.insert.Close()
 
-	mx.Lock()
-	defer mx.Unlock()
-
-	if opt.InitData {
-		if opt.Query != "" {
-			_, err = conn.CopyTo(ctx, &t, "COPY ("+opt.Query+") TO STDOUT WITH BINARY;")
-		} else {
-			_, err = conn.CopyTo(ctx, &t, "COPY BINARY "+t.dbName+" TO STDOUT;")
-		}
-		if err != nil {
-			return fmt.Errorf("copy err: %v", err)
-		}
+	t.opt = opt
+	t.insert, err = db.Prepare(opt.insertSQL("INSERT", target, t.names))
+	if err != nil {
+		return nil, fmt.Errorf("sqlite prepare err: %v", err)
 	}
-
-	return nil
+	return t, nil
 }
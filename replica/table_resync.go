@@ -0,0 +1,22 @@
+package replica
+
+import (
+	"fmt"
+)
+
+// TableResync - reloads a cached table from a consistent snapshot,
+// readers keep seeing the old rows until the new copy is swapped in
+func TableResync(name string) error {
+	opt, err := findTable(name)
+	if err != nil {
+		return err
+	}
+
+	conn, err := pgConnect()
+	if err != nil {
+		return fmt.Errorf("pg connerct err: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	return reload(conn, opt)
+}
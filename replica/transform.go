@@ -0,0 +1,112 @@
+package replica
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+)
+
+// TransformFunc - changes the decoded row in place before it is stored.
+// names are the pg column names of the row values.
+type TransformFunc func(names []string, row []driver.Value) error
+
+// ComputedColumn - sqlite column calculated from the pg row
+type ComputedColumn struct {
+	Name string `json:"name"`
+	// Type - sqlite column type
+	Type string `json:"type"`
+	// Expr - sqlite expression, the pg columns are available by name
+	Expr string `json:"expr"`
+}
+
+// transformed - the stored values are calculated by sqlite expressions
+func (o *AddOptions) transformed() bool {
+	return o != nil && (len(o.Expressions) > 0 || len(o.Computed) > 0)
+}
+
+// transform - runs the Go transform on the row
+func (o *AddOptions) transform(names []string, row []driver.Value) error {
+	if o == nil || o.Transform == nil {
+		return nil
+	}
+	err := o.Transform(names, row)
+	if err != nil {
+		return fmt.Errorf("transform %s err: %v", o.TableName, err)
+	}
+	return nil
+}
+
+// checkTransform - expressions must refer to the stored columns
+func (o *AddOptions) checkTransform() error {
+	for name := range o.Expressions {
+		if len(o.Columns) > 0 && !contains(o.Columns, name) {
+			return fmt.Errorf("expression of %s: column is not cached", name)
+		}
+	}
+	for _, c := range o.Computed {
+		if c.Name == "" || c.Expr == "" {
+			return fmt.Errorf("computed column of %s: name and expr are required", o.TableName)
+		}
+		if len(o.Columns) > 0 && contains(o.Columns, c.Name) {
+			return fmt.Errorf("computed column %s is a cached pg column", c.Name)
+		}
+	}
+	return nil
+}
+
+// values - quoted sqlite columns and the source of their values.
+// The ? parameters are the pg columns names in order.
+func (o *AddOptions) values(names []string) (cols []string, src string) {
+	params := make([]string, len(names))
+	for i, n := range names {
+		cols = append(cols, quoteIdent(n))
+		params[i] = "?"
+	}
+	if !o.transformed() {
+		return cols, fmt.Sprintf("VALUES (%s)", strings.Join(params, ", "))
+	}
+	exprs := make([]string, len(names))
+	for i, n := range names {
+		params[i] = "? AS " + quoteIdent(n)
+		exprs[i] = quoteIdent(n)
+		if e, ok := o.Expressions[n]; ok {
+			exprs[i] = e
+		}
+	}
+	for _, c := range o.Computed {
+		cols = append(cols, quoteIdent(c.Name))
+		exprs = append(exprs, c.Expr)
+	}
+	return cols, fmt.Sprintf("SELECT %s FROM (SELECT %s)", strings.Join(exprs, ", "), strings.Join(params, ", "))
+}
+
+// insertSQL - insert of a pg row into the sqlite table
+func (o *AddOptions) insertSQL(verb, table string, names []string) string {
+	cols, src := o.values(names)
+	return fmt.Sprintf("%s INTO %s(%s) %s;", verb, quoteTarget(table), strings.Join(cols, ", "), src)
+}
+
+// updateSQL - update of the row with the key, the key is the last parameter
+func (o *AddOptions) updateSQL(table string, names []string, key string) string {
+	cols, src := o.values(names)
+	var set string
+	if o.transformed() {
+		set = fmt.Sprintf("(%s) = (%s)", strings.Join(cols, ", "), src)
+	} else {
+		for i := range cols {
+			cols[i] += " = ?"
+		}
+		set = strings.Join(cols, ", ")
+	}
+	return fmt.Sprintf("UPDATE %s SET %s WHERE %s = %s;", quoteTarget(table), set, quoteIdent(key), o.keyParam(key))
+}
+
+// keyParam - the pg key value as it is stored
+func (o *AddOptions) keyParam(key string) string {
+	if o != nil {
+		if e, ok := o.Expressions[key]; ok {
+			return fmt.Sprintf("(SELECT %s FROM (SELECT ? AS %s))", e, quoteIdent(key))
+		}
+	}
+	return "?"
+}
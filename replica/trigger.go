@@ -0,0 +1,421 @@
+package replica
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bendersilver/glog"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// capture modes
+const (
+	captureLogical = "logical"
+	captureTrigger = "trigger"
+)
+
+// captureMode - logical replication or triggers writing a changelog table
+var captureMode = captureLogical
+
+// SetCaptureMode - logical (default) or trigger. The trigger mode needs neither
+// the REPLICATION privilege nor wal_level=logical: TableAdd installs triggers
+// writing the changes to a changelog table, which is polled over a normal connection.
+func SetCaptureMode(mode string) error {
+	switch mode {
+	case captureLogical, captureTrigger:
+		captureMode = mode
+		return nil
+	}
+	return fmt.Errorf("unknown capture mode %q", mode)
+}
+
+// changelogSchema - pg schema of the changelog table and the trigger function
+var changelogSchema = "public"
+
+// trigger mode objects, named after the slot so deployments don't share them
+func changelogTable() string   { return quoteTable(changelogSchema, slotName+"_changelog") }
+func captureFunction() string  { return quoteTable(changelogSchema, slotName+"_capture") }
+func changelogChannel() string { return slotName + "_changelog" }
+func rowTrigger() string       { return slotName + "_row" }
+func truncateTrigger() string  { return slotName + "_truncate" }
+
+// installChangelog - creates the changelog table and the trigger function
+func installChangelog(conn *pgconn.PgConn) error {
+	_, err := conn.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			id bigserial PRIMARY KEY,
+			txid bigint NOT NULL DEFAULT txid_current(),
+			shema text NOT NULL,
+			tbl text NOT NULL,
+			op "char" NOT NULL,
+			old jsonb,
+			new jsonb
+		);
+		CREATE OR REPLACE FUNCTION %[2]s() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			INSERT INTO %[1]s (shema, tbl, op, old, new) VALUES (
+				TG_TABLE_SCHEMA, TG_TABLE_NAME, left(TG_OP, 1),
+				CASE WHEN TG_OP IN ('UPDATE', 'DELETE') THEN to_jsonb(OLD) END,
+				CASE WHEN TG_OP IN ('INSERT', 'UPDATE') THEN to_jsonb(NEW) END
+			);
+			PERFORM pg_notify(%[3]s, '');
+			RETURN NULL;
+		END
+		$$;
+		`, changelogTable(), captureFunction(), quoteLiteral(changelogChannel()))).ReadAll()
+	if err != nil {
+		return fmt.Errorf("pg create changelog err: %v", err)
+	}
+	return nil
+}
+
+// installTriggers - the row and truncate triggers of the table relations, returns the relations done
+func installTriggers(conn *pgconn.PgConn, opt *AddOptions) (done []pgRelation, err error) {
+	for _, rel := range opt.published {
+		table := quoteTable(rel.shema, rel.table)
+		// one query string runs as one transaction
+		_, err = conn.Exec(ctx, fmt.Sprintf(`
+			DROP TRIGGER IF EXISTS %[2]s ON %[1]s;
+			CREATE TRIGGER %[2]s AFTER INSERT OR UPDATE OR DELETE ON %[1]s
+				FOR EACH ROW EXECUTE PROCEDURE %[4]s();
+			DROP TRIGGER IF EXISTS %[3]s ON %[1]s;
+			CREATE TRIGGER %[3]s AFTER TRUNCATE ON %[1]s
+				FOR EACH STATEMENT EXECUTE PROCEDURE %[4]s();
+			`, table, quoteIdent(rowTrigger()), quoteIdent(truncateTrigger()), captureFunction())).ReadAll()
+		if err != nil {
+			return done, fmt.Errorf("pg create triggers on %s err: %v", table, err)
+		}
+		done = append(done, rel)
+	}
+	return done, nil
+}
+
+// dropTriggers - removes the triggers and the changes of the table not consumed yet
+func dropTriggers(conn *pgconn.PgConn, rels []pgRelation) error {
+	for _, rel := range rels {
+		table := quoteTable(rel.shema, rel.table)
+		_, err := conn.Exec(ctx, fmt.Sprintf(`
+			DROP TRIGGER IF EXISTS %[2]s ON %[1]s;
+			DROP TRIGGER IF EXISTS %[3]s ON %[1]s;
+			DELETE FROM %[4]s WHERE shema = %[5]s AND tbl = %[6]s;
+			`, table, quoteIdent(rowTrigger()), quoteIdent(truncateTrigger()), changelogTable(),
+			quoteLiteral(rel.shema), quoteLiteral(rel.table))).ReadAll()
+		if err != nil {
+			return fmt.Errorf("pg drop triggers on %s err: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// reconcileTriggers - drops the triggers of the tables that are not cached
+func reconcileTriggers(conn *pgconn.PgConn) error {
+	res := conn.ExecParams(ctx, `
+		SELECT n.nspname, c.relname
+		FROM pg_catalog.pg_trigger t
+		JOIN pg_catalog.pg_class c ON c.oid = t.tgrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE t.tgname = $1;
+		`, [][]byte{[]byte(rowTrigger())}, nil, nil, nil).Read()
+	if res.Err != nil {
+		return fmt.Errorf("pg get pg_trigger err: %v", res.Err)
+	}
+	var rels []pgRelation
+	for _, row := range res.Rows {
+		rel := pgRelation{string(row[0]), string(row[1])}
+		mx.Lock()
+		opt := cachedTable(rel.shema, rel.table)
+		mx.Unlock()
+		if opt == nil || opt.refreshMode() {
+			glog.Noticef("table %s.%s is not streamed, removing its triggers", rel.shema, rel.table)
+			rels = append(rels, rel)
+		}
+	}
+	return dropTriggers(conn, rels)
+}
+
+// runTrigger - applies the changelog, reconnects on errors
+func (r *replication) runTrigger() {
+	for {
+		src, err := newTriggerSource()
+		if err != nil {
+			glog.Error(err)
+			time.Sleep(time.Second * 5)
+			continue
+		}
+		for {
+			ev, err := src.Next(ctx)
+			if err != nil {
+				glog.Error(err)
+				break
+			}
+			err = r.event(ev)
+			if err != nil {
+				glog.Error(err)
+			}
+		}
+		src.conn.Close(ctx)
+		time.Sleep(time.Second * 5)
+	}
+}
+
+// triggerSource - events of the changelog table. Rows are consumed in id order once every
+// transaction that could have written a smaller id has finished, they are deleted as they are read.
+// Event positions are changelog ids.
+type triggerSource struct {
+	conn     *pgconn.PgConn
+	notified bool
+	// pollInterval - the changelog is read at least this often without notifications
+	pollInterval time.Duration
+	batch        int
+	ids          map[pgRelation]uint32
+	rels         map[uint32]*Relation
+	events       []*Event
+}
+
+func newTriggerSource() (*triggerSource, error) {
+	s := &triggerSource{
+		pollInterval: time.Second,
+		batch:        10000,
+		ids:          make(map[pgRelation]uint32),
+		rels:         make(map[uint32]*Relation),
+	}
+	config := r.config.Copy()
+	config.OnNotification = func(*pgconn.PgConn, *pgconn.Notification) {
+		s.notified = true
+	}
+	var err error
+	s.conn, err = pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("pg connerct err: %v", err)
+	}
+	_, err = s.conn.Exec(ctx, "LISTEN "+quoteIdent(changelogChannel())+";").ReadAll()
+	if err != nil {
+		s.conn.Close(ctx)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Next - Source
+func (s *triggerSource) Next(ctx context.Context) (*Event, error) {
+	for len(s.events) == 0 {
+		s.notified = false
+		err := s.poll()
+		if err != nil {
+			return nil, err
+		}
+		if len(s.events) > 0 || s.notified {
+			continue
+		}
+		wctx, cancel := context.WithTimeout(ctx, s.pollInterval)
+		err = s.conn.WaitForNotification(wctx)
+		cancel()
+		if err != nil && !pgconn.Timeout(err) {
+			return nil, err
+		}
+	}
+	ev := s.events[0]
+	s.events = s.events[1:]
+	return ev, nil
+}
+
+// changelogPosition - last changelog id committed before the current snapshot,
+// the position of the trigger mode that a reader waits for instead of a WAL LSN
+func changelogPosition(conn *pgconn.PgConn) (pglogrepl.LSN, error) {
+	res := conn.ExecParams(ctx, fmt.Sprintf("SELECT coalesce(max(id), 0)::text FROM %s;", changelogTable()),
+		nil, nil, nil, nil).Read()
+	if res.Err != nil {
+		return 0, fmt.Errorf("pg get changelog position err: %v", res.Err)
+	}
+	n, err := strconv.ParseUint(string(res.Rows[0][0]), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pglogrepl.LSN(n), nil
+}
+
+// poll - consumes a batch of the changelog as one transaction
+func (s *triggerSource) poll() error {
+	res := s.conn.ExecParams(ctx, fmt.Sprintf(`
+		DELETE FROM %[1]s
+		WHERE id IN (
+			SELECT id FROM %[1]s
+			WHERE txid < txid_snapshot_xmin(txid_current_snapshot())
+			ORDER BY id
+			LIMIT $1
+		)
+		RETURNING id, shema, tbl, op, old, new;
+		`, changelogTable()), [][]byte{[]byte(strconv.Itoa(s.batch))}, nil, nil, nil).Read()
+	if res.Err != nil {
+		return fmt.Errorf("pg read changelog err: %v", res.Err)
+	}
+	if len(res.Rows) == 0 {
+		return nil
+	}
+	sort.Slice(res.Rows, func(i, j int) bool {
+		a, _ := strconv.ParseInt(string(res.Rows[i][0]), 10, 64)
+		b, _ := strconv.ParseInt(string(res.Rows[j][0]), 10, 64)
+		return a < b
+	})
+
+	s.events = append(s.events, &Event{Kind: EventBegin})
+	var last int64
+	for _, row := range res.Rows {
+		last, _ = strconv.ParseInt(string(row[0]), 10, 64)
+		ev, err := s.change(pgRelation{string(row[1]), string(row[2])}, string(row[3]), row[4], row[5])
+		if err != nil {
+			glog.Errorf("changelog %d: %v", last, err)
+			continue
+		}
+		s.events = append(s.events, ev...)
+	}
+	// the position is the changelog id, it is never compared with WAL positions
+	s.events = append(s.events, &Event{Kind: EventCommit, LSN: pglogrepl.LSN(last)})
+	return nil
+}
+
+// change - events of a changelog row, the relation event comes first if the table is new or altered
+func (s *triggerSource) change(key pgRelation, op string, oldRow, newRow []byte) ([]*Event, error) {
+	var events []*Event
+	id, ok := s.ids[key]
+	if !ok {
+		id = uint32(len(s.ids) + 1)
+		s.ids[key] = id
+	}
+	if op == "T" {
+		if s.rels[id] == nil {
+			rel, err := s.relation(id, key)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, &Event{Kind: EventRelation, Relation: rel})
+		}
+		return append(events, &Event{Kind: EventTruncate, RelationIDs: []uint32{id}}), nil
+	}
+
+	var o, n map[string]json.RawMessage
+	if oldRow != nil {
+		err := json.Unmarshal(oldRow, &o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if newRow != nil {
+		err := json.Unmarshal(newRow, &n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	row := n
+	if row == nil {
+		row = o
+	}
+	rel := s.rels[id]
+	if rel == nil || !sameNames(rel, row) {
+		var err error
+		rel, err = s.relation(id, key)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &Event{Kind: EventRelation, Relation: rel})
+	}
+
+	ev := &Event{RelationID: id}
+	var err error
+	switch op {
+	case "I":
+		ev.Kind = EventInsert
+		ev.New, err = triggerValues(rel, n)
+	case "U":
+		ev.Kind = EventUpdate
+		ev.Old, err = triggerValues(rel, o)
+		if err == nil {
+			ev.New, err = triggerValues(rel, n)
+		}
+	case "D":
+		ev.Kind = EventDelete
+		ev.Old, err = triggerValues(rel, o)
+	default:
+		return nil, fmt.Errorf("unknown op %q", op)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s.%s: %v", key.shema, key.table, err)
+	}
+	return append(events, ev), nil
+}
+
+// relation - columns of the table read from the catalog
+func (s *triggerSource) relation(id uint32, key pgRelation) (*Relation, error) {
+	res := s.conn.ExecParams(ctx, `
+		SELECT a.attname, a.atttypid::text, coalesce(a.attnum = ANY(i.indkey), false)
+		FROM pg_catalog.pg_attribute a
+		LEFT JOIN LATERAL (
+			SELECT indkey::int2[]
+			FROM pg_catalog.pg_index
+			WHERE indrelid = a.attrelid AND (indisprimary OR indisreplident)
+			ORDER BY indisprimary DESC
+			LIMIT 1
+		) i ON true
+		WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum;
+		`, [][]byte{[]byte(quoteTable(key.shema, key.table))}, nil, nil, nil).Read()
+	if res.Err != nil {
+		return nil, fmt.Errorf("pg get columns err: %v", res.Err)
+	}
+	rel := &Relation{ID: id, Namespace: key.shema, Name: key.table}
+	for _, row := range res.Rows {
+		oid, err := strconv.ParseUint(string(row[1]), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		rel.Columns = append(rel.Columns, Column{Name: string(row[0]), Type: uint32(oid), Key: string(row[2]) == "t"})
+	}
+	s.rels[id] = rel
+	return rel, nil
+}
+
+// sameNames - the row has the relation columns
+func sameNames(rel *Relation, row map[string]json.RawMessage) bool {
+	if len(rel.Columns) != len(row) {
+		return false
+	}
+	for _, c := range rel.Columns {
+		if _, ok := row[c.Name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// triggerValues - row of to_jsonb in the relation column order
+func triggerValues(rel *Relation, row map[string]json.RawMessage) ([]driver.Value, error) {
+	vals := make([]driver.Value, len(rel.Columns))
+	for i, c := range rel.Columns {
+		v, err := jsonValue(c.Type, jsonbTime(c.Type, row[c.Name]))
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", c.Name, err)
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// jsonbTime - to_jsonb writes timestamps in ISO 8601, pg text has a space instead of T
+func jsonbTime(oid uint32, v json.RawMessage) json.RawMessage {
+	switch oid {
+	case pgtype.TimestampOID, pgtype.TimestamptzOID:
+		if len(v) > 12 && v[0] == '"' && v[11] == 'T' {
+			b := append(json.RawMessage(nil), v...)
+			b[11] = ' '
+			return b
+		}
+	}
+	return v
+}
@@ -1,11 +1,9 @@
 package replica
 
 import (
-	"bytes"
+	"context"
 	"database/sql/driver"
-	"encoding/binary"
 	"fmt"
-	"io"
 	"sync"
 
 	"github.com/bendersilver/glog"
@@ -15,10 +13,26 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+// output plugins
 const (
-	plugin = "pgoutput"
+	pluginPgoutput = "pgoutput"
+	pluginWal2json = "wal2json"
 )
 
+// plugin - output plugin of the slot
+var plugin = pluginPgoutput
+
+// SetPlugin - pgoutput or wal2json. wal2json needs no publication,
+// the stream is limited to the cached tables with add-tables.
+func SetPlugin(name string) error {
+	switch name {
+	case pluginPgoutput, pluginWal2json:
+		plugin = name
+		return nil
+	}
+	return fmt.Errorf("unknown output plugin %q", name)
+}
+
 var slotName = "pgcache_slot"
 
 // SetSlotName -
@@ -26,87 +40,189 @@ func SetSlotName(name string) {
 	slotName = name
 }
 
+// temporarySlot - the slot is dropped by pg when the replication connection closes
+var temporarySlot bool
+
+// SetTemporarySlot - no slot is left behind after a crash,
+// every reconnect creates a new slot and reloads the cached tables
+func SetTemporarySlot(temporary bool) {
+	temporarySlot = temporary
+}
+
+// pubName - publication name, the slot name is used if empty
+var pubName string
+
+// SetPublication -
+func SetPublication(name string) {
+	pubName = name
+}
+
+func publication() string {
+	if pubName != "" {
+		return pubName
+	}
+	return slotName
+}
+
+// externalPublication - the publication is managed outside of pgcache,
+// it is never created, dropped or altered
+var externalPublication bool
+
+// SetExternalPublication - use an existing publication, e.g. `FOR ALL TABLES`
+// or `FOR TABLES IN SCHEMA`. Changes of the tables that are not cached are skipped.
+func SetExternalPublication(external bool) {
+	externalPublication = external
+}
+
+// managedPublication - pgcache creates the publication and adds the cached tables to it
+func managedPublication() bool {
+	return captureMode == captureLogical && plugin == pluginPgoutput && !externalPublication
+}
+
+// appName - application_name of the connections, the slot name is used if empty
+var appName string
+
+// SetApplicationName -
+func SetApplicationName(name string) {
+	appName = name
+}
+
+func applicationName() string {
+	if appName != "" {
+		return appName
+	}
+	return slotName
+}
+
 var mx sync.Mutex
 var db *sqlite.Conn
+
+// tables - cached tables by sqlite name
+var tables = make(map[string]*AddOptions)
 var mi = pgtype.NewMap()
 var signature = []byte{0x50, 0x47, 0x43, 0x4F, 0x50, 0x59, 0x0A, 0xFF, 0x0D, 0x0A, 0x00}
 
 // replication -
 type replication struct {
-	pgURL string
-
-	conn      *pgconn.PgConn
-	lsn       pglogrepl.LSN
+	config *pgconn.Config
+	// host - address of the server the replication is connected to
+	host string
+
+	conn *pgconn.PgConn
+	// received - end of the last WAL data received from the server
+	received pglogrepl.LSN
+	// applied - end LSN of the last transaction applied to sqlite
+	applied lsnWaiter
+	// flushed - end LSN of the last transaction committed in sqlite,
+	// the slot is confirmed up to this position
+	flushed pglogrepl.LSN
+	inTx    bool
+	// batch - open sqlite transaction of the stream, mx must be held
+	batch batch
+	// reload - the slot was recreated, cached tables must be reloaded
+	reload bool
+	// viaRoot - the publication publishes partition changes as the partitioned table
+	viaRoot bool
+	// cancel - stops the running stream
+	cancel    context.CancelFunc
 	relations map[uint32]*relationItem
 }
 
 type tmpTable struct {
-	readSign bool
-	dbName   string
-	field    []pgconn.FieldDescription
-	insert   *sqlite.Stmt
+	dbName string
+	field  []pgconn.FieldDescription
+	names  []string
+	opt    *AddOptions
+	insert *sqlite.Stmt
+	dec    *copyDecoder
+	// rows, bytes - copied so far
+	rows  int64
+	bytes int64
+	// shared - the stream writes sqlite during the copy, the rows are kept
+	// in pending and written under mx shareRows at a time
+	shared  bool
+	pending [][]driver.Value
 }
 
-func readInt32(r io.Reader) int32 {
-	var buf [4]byte
-	if _, err := io.ReadFull(r, buf[:]); err != nil {
-		return 0
+// shareRows - rows of a shared copy written in one sqlite transaction
+const shareRows = 1000
+
+// copy - runs a COPY BINARY query into the table
+func (t *tmpTable) copy(conn *pgconn.PgConn, sql string) error {
+	t.dec = nil
+	t.pending = t.pending[:0]
+	_, err := conn.CopyTo(ctx, t, sql)
+	if err != nil {
+		return err
 	}
-	return int32(binary.BigEndian.Uint32(buf[:]))
+	return t.Close()
 }
-func readInt16(r io.Reader) int16 {
-	var buf [2]byte
-	if _, err := io.ReadFull(r, buf[:]); err != nil {
-		return 0
+
+// Write - io.Writer of COPY BINARY
+func (t *tmpTable) Write(src []byte) (n int, err error) {
+	if t.dec == nil {
+		t.dec = newCopyDecoder(t.field, t.row)
 	}
-	return int16(binary.BigEndian.Uint16(buf[:]))
+	t.bytes += int64(len(src))
+	return t.dec.Write(src)
 }
 
-// Write - io.Writer
-func (t *tmpTable) Write(src []byte) (n int, err error) {
-	buf := bytes.NewBuffer(src)
-	n = buf.Len()
-	if !t.readSign {
+// Close - checks the end of the copied stream
+func (t *tmpTable) Close() error {
+	if t.dec == nil {
+		return fmt.Errorf("copy of %s sent no data", t.dbName)
+	}
+	err := t.dec.Close()
+	if err != nil {
+		return err
+	}
+	return t.writePending()
+}
 
-		if !bytes.Equal(buf.Next(len(signature)), signature) {
-			return 0, fmt.Errorf("invalid file signature: %s", signature)
+func (t *tmpTable) row(vals []driver.Value) error {
+	if t.shared {
+		// the decoder reuses the values
+		t.pending = append(t.pending, copyValues(vals))
+		if len(t.pending) < shareRows {
+			return nil
 		}
-		flags := readInt32(buf)
-		extensionSize := readInt32(buf)
-		_ = flags
-		extension := make([]byte, extensionSize)
+		return t.writePending()
+	}
+	return t.insertRow(vals)
+}
 
-		if _, err := io.ReadFull(buf, extension); err != nil {
-			return 0, fmt.Errorf("can't read header extension: %v", err)
-		}
-		t.readSign = true
+func (t *tmpTable) insertRow(vals []driver.Value) error {
+	err := t.opt.transform(t.names, vals)
+	if err != nil {
+		return err
 	}
+	t.rows++
+	return t.insert.Exec(vals...)
+}
 
-	tupleLen := readInt16(buf)
-	// EOF
-	if tupleLen == -1 {
-		return
+// writePending - writes the kept rows of a shared copy in their own sqlite transaction,
+// the open batch of the stream is committed first
+func (t *tmpTable) writePending() error {
+	if len(t.pending) == 0 {
+		return nil
 	}
-	vals := make([]driver.Value, tupleLen)
-	for i := 0; i < int(tupleLen); i++ {
-		colLen := readInt32(buf)
-		// column is nil
-		if colLen == -1 {
-			vals[i] = nil
-			continue
-		}
-		col := make([]byte, colLen)
-		if _, err := io.ReadFull(buf, col); err != nil {
-			return 0, fmt.Errorf("can't read column %v", err)
-		}
-		vals[i], err = decodeColumn(pgtype.BinaryFormatCode, t.field[i].DataTypeOID, col)
+	mx.Lock()
+	defer mx.Unlock()
+	r.flush()
+	err := db.Exec("SAVEPOINT shared;")
+	if err != nil {
+		return err
+	}
+	for _, vals := range t.pending {
+		err = t.insertRow(vals)
 		if err != nil {
-			return 0, err
+			db.Exec("ROLLBACK TO shared;")
+			db.Exec("RELEASE shared;")
+			return err
 		}
 	}
-
-	err = t.insert.Exec(vals...)
-	return
+	t.pending = t.pending[:0]
+	return db.Exec("RELEASE shared;")
 }
 
 func decodeColumn(format int16, oid uint32, data []byte) (v driver.Value, err error) {
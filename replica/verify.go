@@ -0,0 +1,511 @@
+package replica
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/bendersilver/glog"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// VerifyOptions -
+type VerifyOptions struct {
+	// RangeSize - rows per key range, 10000 by default
+	RangeSize int
+	// Repair - reload the mismatched ranges from pg
+	Repair bool
+	// Interval - period of StartVerifier
+	Interval time.Duration
+	// Timeout - how long to wait for the cache to reach the pg position of a range, 30s by default
+	Timeout time.Duration
+}
+
+// RangeMismatch -
+type RangeMismatch struct {
+	// From, To - key bounds in pg text format, From is exclusive, To inclusive, empty is unbounded
+	From      string
+	To        string
+	PgRows    int
+	CacheRows int
+	Repaired  bool
+}
+
+// VerifyResult -
+type VerifyResult struct {
+	Table string
+	Time  time.Time
+	// LSN - pg position of the last range, the changelog id in trigger capture mode
+	LSN        string
+	PgRows     int
+	CacheRows  int
+	Ranges     int
+	Mismatches []RangeMismatch
+	Err        string
+}
+
+// verifies - last results by sqlite name
+var verifies = make(map[string]*VerifyResult)
+
+// keyRange - (from, to], unbounded sides have no value
+type keyRange struct {
+	from, to       []byte
+	hasFrom, hasTo bool
+}
+
+func (k keyRange) String() string {
+	return fmt.Sprintf("(%s, %s]", k.from, k.to)
+}
+
+type verifier struct {
+	opt     VerifyOptions
+	conn    *pgconn.PgConn
+	table   *AddOptions
+	target  string
+	src     string
+	key     string
+	keyOID  uint32
+	collate string
+	check   string
+	fields  []pgconn.FieldDescription
+}
+
+// StartVerifier - verifies every cached table each opt.Interval
+func StartVerifier(opt VerifyOptions) error {
+	if opt.Interval <= 0 {
+		return fmt.Errorf("verify interval must be positive")
+	}
+	go func() {
+		for range time.Tick(opt.Interval) {
+			mx.Lock()
+			names := make([]string, 0, len(tables))
+			for _, t := range tables {
+				if !t.refreshMode() && t.Transform == nil {
+					names = append(names, t.TableName)
+				}
+			}
+			mx.Unlock()
+
+			for _, name := range names {
+				_, err := Verify(name, opt)
+				if err != nil {
+					glog.Error(err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Verify - compares row counts and per key range checksums of a cached table with pg.
+// Every range is read from pg first, the cache is compared after it has applied the pg position of the read.
+func Verify(name string, opt VerifyOptions) (*VerifyResult, error) {
+	if opt.RangeSize <= 0 {
+		opt.RangeSize = 10000
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = time.Second * 30
+	}
+	table, err := findTable(name)
+	if err != nil {
+		return nil, err
+	}
+	if table.refreshMode() {
+		return nil, fmt.Errorf("table %s is refreshed, not streamed", name)
+	}
+	if table.Transform != nil {
+		// the pg rows can't be transformed the same way, the key may be rewritten too
+		return nil, fmt.Errorf("table %s has a transform, the cached rows can't be compared", name)
+	}
+	target := table.tableName()
+
+	v := &verifier{
+		opt:    opt,
+		table:  table,
+		target: target,
+		src:    quoteTable(table.shema, table.table),
+		check:  target + "__verify",
+	}
+	if table.Query != "" || len(table.Columns) > 0 {
+		v.src = "(" + table.source() + ") q"
+	}
+	res := &VerifyResult{Table: name, Time: time.Now()}
+	err = v.run(res)
+	if err != nil {
+		res.Err = err.Error()
+	}
+
+	for _, m := range res.Mismatches {
+		glog.Warningf("verify %s: range (%s, %s] pg %d rows, cache %d rows, repaired %v",
+			name, m.From, m.To, m.PgRows, m.CacheRows, m.Repaired)
+	}
+	mx.Lock()
+	verifies[target] = res
+	mx.Unlock()
+	return res, err
+}
+
+func (v *verifier) run(res *VerifyResult) (err error) {
+	v.conn, err = pgConnect()
+	if err != nil {
+		return fmt.Errorf("pg connerct err: %v", err)
+	}
+	defer v.conn.Close(ctx)
+
+	err = v.keyColumn()
+	if err != nil {
+		return err
+	}
+
+	check := quoteTarget(v.check)
+	mx.Lock()
+	r.flush()
+	err = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s; CREATE TABLE %s AS SELECT * FROM %s WHERE 0;", check, check, quoteTarget(v.target)))
+	mx.Unlock()
+	if err != nil {
+		return fmt.Errorf("sqlite create table err: %v", err)
+	}
+	defer func() {
+		mx.Lock()
+		r.flush()
+		db.Exec("DROP TABLE IF EXISTS " + check + ";")
+		mx.Unlock()
+	}()
+
+	var rng keyRange
+	for {
+		rows, keyIx, lsn, err := v.pgRange(rng, v.opt.RangeSize)
+		if err != nil {
+			return err
+		}
+		if len(rows) == v.opt.RangeSize {
+			rng.to = rows[len(rows)-1][keyIx]
+			rng.hasTo = true
+		}
+
+		pgRows, cacheRows, equal, err := v.compare(rng, rows, lsn)
+		if err != nil {
+			return err
+		}
+		if !equal {
+			// the cache may be ahead of the pg snapshot, check the range once more
+			rows, _, lsn, err = v.pgRange(rng, 0)
+			if err != nil {
+				return err
+			}
+			pgRows, cacheRows, equal, err = v.compare(rng, rows, lsn)
+			if err != nil {
+				return err
+			}
+		}
+
+		res.Ranges++
+		res.PgRows += pgRows
+		res.CacheRows += cacheRows
+		res.LSN = lsn.String()
+		if !equal {
+			m := RangeMismatch{
+				From:      string(rng.from),
+				To:        string(rng.to),
+				PgRows:    pgRows,
+				CacheRows: cacheRows,
+			}
+			if v.opt.Repair {
+				err = v.repair(rng)
+				if err != nil {
+					glog.Errorf("verify %s: repair %s err: %v", v.table.TableName, rng, err)
+				} else {
+					m.Repaired = true
+				}
+			}
+			res.Mismatches = append(res.Mismatches, m)
+		}
+
+		if !rng.hasTo {
+			return nil
+		}
+		rng = keyRange{from: rng.to, hasFrom: true}
+	}
+}
+
+// keyColumn - primary key or replica identity column of the table
+func (v *verifier) keyColumn() error {
+	name, oid, collatable, err := tableKey(v.conn, v.table)
+	if err != nil {
+		return err
+	}
+	if _, ok := v.table.Expressions[name]; ok {
+		return fmt.Errorf("key column %s of %s is transformed, ranges can't be compared", name, v.table.TableName)
+	}
+	v.key = quoteIdent(name)
+	v.keyOID = oid
+	if collatable {
+		// sqlite compares text by bytes
+		v.collate = ` COLLATE "C"`
+	}
+	return nil
+}
+
+// tableKey - first column of the primary key or the replica identity index of the pg table
+func tableKey(conn *pgconn.PgConn, opt *AddOptions) (name string, oid uint32, collatable bool, err error) {
+	res := conn.ExecParams(ctx, `
+		SELECT a.attname, a.atttypid::text, a.attcollation <> 0
+		FROM pg_catalog.pg_index i
+		JOIN pg_catalog.pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]
+		WHERE i.indrelid = $1::regclass AND (i.indisprimary OR i.indisreplident)
+		ORDER BY i.indisprimary DESC
+		LIMIT 1;
+		`, [][]byte{[]byte(quoteTable(opt.shema, opt.table))}, nil, nil, nil).Read()
+	if res.Err != nil {
+		return "", 0, false, fmt.Errorf("pg get key column err: %v", res.Err)
+	}
+	if len(res.Rows) == 0 {
+		return "", 0, false, fmt.Errorf("table %s has no primary key or replica identity index", opt.TableName)
+	}
+	row := res.Rows[0]
+	var n uint64
+	_, err = fmt.Sscan(string(row[1]), &n)
+	if err != nil {
+		return "", 0, false, err
+	}
+	return string(row[0]), uint32(n), string(row[2]) == "t", nil
+}
+
+// pgRange - rows of the range ordered by key and the pg position they were read at
+func (v *verifier) pgRange(rng keyRange, limit int) (rows [][][]byte, keyIx int, lsn pglogrepl.LSN, err error) {
+	where := []string{"true"}
+	var params [][]byte
+	if rng.hasFrom {
+		params = append(params, rng.from)
+		where = append(where, fmt.Sprintf("%s%s > $%d", v.key, v.collate, len(params)))
+	}
+	if rng.hasTo {
+		params = append(params, rng.to)
+		where = append(where, fmt.Sprintf("%s%s <= $%d", v.key, v.collate, len(params)))
+	}
+	sql := fmt.Sprintf("SELECT * FROM %s WHERE %s ORDER BY %s%s",
+		v.src,
+		strings.Join(where, " AND "),
+		v.key,
+		v.collate,
+	)
+	if limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	rr := v.conn.ExecParams(ctx, sql, params, nil, nil, nil)
+	for rr.NextRow() {
+		// ResultReader.Read turns NULL into empty values
+		row := make([][]byte, len(rr.Values()))
+		for i, val := range rr.Values() {
+			if val != nil {
+				row[i] = append([]byte{}, val...)
+			}
+		}
+		rows = append(rows, row)
+	}
+	fields := rr.FieldDescriptions()
+	_, err = rr.Close()
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("pg read range err: %v", err)
+	}
+	keyIx = -1
+	for i, f := range fields {
+		if quoteIdent(f.Name) == v.key {
+			keyIx = i
+		}
+	}
+	if keyIx < 0 {
+		return nil, 0, 0, fmt.Errorf("key column %s not found", v.key)
+	}
+
+	// the commits visible to the range read are before the current position
+	if captureMode == captureTrigger {
+		lsn, err = changelogPosition(v.conn)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		v.fields = append(v.fields[:0], fields...)
+		return rows, keyIx, lsn, nil
+	}
+	pos := v.conn.Exec(ctx, "SELECT pg_current_wal_lsn();")
+	lres, err := pos.ReadAll()
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("pg current lsn err: %v", err)
+	}
+	lsn, err = pglogrepl.ParseLSN(string(lres[0].Rows[0][0]))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	v.fields = append(v.fields[:0], fields...)
+	return rows, keyIx, lsn, nil
+}
+
+// compare - loads pg rows into the check table and compares it with the cached range
+func (v *verifier) compare(rng keyRange, rows [][][]byte, lsn pglogrepl.LSN) (pgRows, cacheRows int, equal bool, err error) {
+	// r.applied is waited directly, WaitLSN rejects changelog ids of the trigger mode
+	err = r.applied.wait(lsn, v.opt.Timeout)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("cache did not reach %s: %v", lsn, err)
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+
+	err = v.fill(rows)
+	if err != nil {
+		return
+	}
+	pgRows, pgSum, err := v.checksum(v.check, rng)
+	if err != nil {
+		return
+	}
+	cacheRows, cacheSum, err := v.checksum(v.target, rng)
+	if err != nil {
+		return
+	}
+	return pgRows, cacheRows, pgRows == cacheRows && pgSum == cacheSum, nil
+}
+
+// fill - replaces the content of the check table with decoded pg rows
+func (v *verifier) fill(rows [][][]byte) error {
+	err := db.Exec("DELETE FROM " + quoteTarget(v.check) + ";")
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(v.fields))
+	for i, f := range v.fields {
+		names[i] = f.Name
+	}
+	insert, err := db.Prepare(v.table.insertSQL("INSERT", v.check, names))
+	if err != nil {
+		return fmt.Errorf("sqlite prepare err: %v", err)
+	}
+	defer insert.Close()
+
+	vals := make([]driver.Value, len(v.fields))
+	for _, row := range rows {
+		for i, col := range row {
+			if col == nil {
+				vals[i] = nil
+				continue
+			}
+			vals[i], err = decodeColumn(pgtype.TextFormatCode, v.fields[i].DataTypeOID, col)
+			if err != nil {
+				return err
+			}
+		}
+		err = v.table.transform(names, vals)
+		if err != nil {
+			return err
+		}
+		err = insert.Exec(vals...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangeWhere - sqlite condition and arguments of the range
+func (v *verifier) rangeWhere(rng keyRange) (string, []driver.Value, error) {
+	where := []string{"1"}
+	var args []driver.Value
+	for _, b := range []struct {
+		ok  bool
+		val []byte
+		op  string
+	}{{rng.hasFrom, rng.from, ">"}, {rng.hasTo, rng.to, "<="}} {
+		if !b.ok {
+			continue
+		}
+		val, err := decodeColumn(pgtype.TextFormatCode, v.keyOID, b.val)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, val)
+		where = append(where, fmt.Sprintf("%s %s ?", v.key, b.op))
+	}
+	return strings.Join(where, " AND "), args, nil
+}
+
+// checksum - row count and fnv hash of the range rows in key order
+func (v *verifier) checksum(table string, rng keyRange) (n int, sum uint64, err error) {
+	where, args, err := v.rangeWhere(rng)
+	if err != nil {
+		return
+	}
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM %s WHERE %s ORDER BY %s;", quoteTarget(table), where, v.key), args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	h := fnv.New64a()
+	for rows.Next() {
+		vals, err := rows.Values()
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, val := range vals {
+			// the check table has no BOOLEAN declared type
+			if b, ok := val.(bool); ok {
+				val = int64(0)
+				if b {
+					val = int64(1)
+				}
+			}
+			fmt.Fprintf(h, "%T:%v|", val, val)
+		}
+		n++
+	}
+	return n, h.Sum64(), rows.Err()
+}
+
+// repair - replaces the cached range with a fresh pg read, changes streamed
+// meanwhile are applied again on top of it and replace the rows of their keys
+func (v *verifier) repair(rng keyRange) error {
+	cl, err := startLog(v.target)
+	if err != nil {
+		return err
+	}
+	defer stopLog(v.target)
+
+	rows, _, _, err := v.pgRange(rng, 0)
+	if err != nil {
+		return err
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+	r.flush()
+	err = v.fill(rows)
+	if err != nil {
+		return err
+	}
+	where, args, err := v.rangeWhere(rng)
+	if err != nil {
+		return err
+	}
+
+	err = db.Exec("BEGIN;")
+	if err != nil {
+		return err
+	}
+	err = db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s;", quoteTarget(v.target), where), args...)
+	if err == nil {
+		err = db.Exec(fmt.Sprintf("INSERT INTO %s SELECT * FROM %s;", quoteTarget(v.target), quoteTarget(v.check)))
+	}
+	if err == nil {
+		err = cl.replay(v.target, v.table)
+	}
+	if err != nil {
+		db.Exec("ROLLBACK;")
+		return err
+	}
+	return db.Exec("COMMIT;")
+}
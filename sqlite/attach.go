@@ -0,0 +1,62 @@
+package sqlite
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// schemas - attached in-memory databases, every connection attaches all of them
+var schemas struct {
+	sync.Mutex
+	names []string
+}
+
+// Attach - attaches the in-memory database name to this and every other connection
+func (c *Conn) Attach(name string) error {
+	if name == "main" || name == "temp" {
+		return nil
+	}
+	schemas.Lock()
+	var found bool
+	for _, n := range schemas.names {
+		if n == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		schemas.names = append(schemas.names, name)
+	}
+	schemas.Unlock()
+	return c.attachAll()
+}
+
+// attachAll - attaches the databases registered after the last call
+func (c *Conn) attachAll() error {
+	c.Lock()
+	defer c.Unlock()
+
+	schemas.Lock()
+	names := append([]string(nil), schemas.names[c.attached:]...)
+	schemas.Unlock()
+
+	for _, name := range names {
+		uri := "file:redispg_" + url.QueryEscape(name) + "?mode=memory&cache=shared"
+		s, err := newStmt(c, fmt.Sprintf(`ATTACH DATABASE '%s' AS "%s";`,
+			strings.ReplaceAll(uri, "'", "''"),
+			strings.ReplaceAll(name, `"`, `""`),
+		))
+		if err != nil {
+			return err
+		}
+		err = s.exec(nil)
+		s.Close()
+		if err != nil {
+			return err
+		}
+		c.attached++
+	}
+	return nil
+}
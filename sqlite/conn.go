@@ -445,6 +445,9 @@ func (c *Conn) Prepare(query string) (*Stmt, error) {
 }
 
 func (c *Conn) prepare(query string) (*Stmt, error) {
+	if err := c.attachAll(); err != nil {
+		return nil, err
+	}
 	return newStmt(c, query)
 }
 
@@ -501,6 +504,8 @@ type Conn struct {
 	sync.Mutex
 	writeTimeFormat string
 	beginMode       string
+	// attached - number of schemas attached to the connection
+	attached int
 }
 
 func newConn() (*Conn, error) {
@@ -13,6 +13,10 @@ import (
 type Stmt struct {
 	c    *Conn
 	psql uintptr
+	// pstmt - compiled single statement kept between executions,
+	// sql of several statements is compiled on every execution
+	pstmt uintptr
+	multi bool
 }
 
 func newStmt(c *Conn, sql string) (*Stmt, error) {
@@ -27,9 +31,13 @@ func newStmt(c *Conn, sql string) (*Stmt, error) {
 
 // Close -
 func (s *Stmt) Close() (err error) {
+	if s.pstmt != 0 {
+		err = s.c.finalize(s.pstmt)
+		s.pstmt = 0
+	}
 	s.c.free(s.psql)
 	s.psql = 0
-	return nil
+	return err
 }
 
 // Exec -
@@ -37,7 +45,84 @@ func (s *Stmt) Exec(args ...driver.Value) error {
 	return s.exec(toNamedValues(args...))
 }
 
-func (s *Stmt) exec(args []driver.NamedValue) (err error) {
+func (s *Stmt) exec(args []driver.NamedValue) error {
+	if s.pstmt == 0 && !s.multi {
+		err := s.compile()
+		if err != nil {
+			return err
+		}
+	}
+	if s.multi {
+		return s.execAll(args)
+	}
+	return s.execCompiled(args)
+}
+
+// compile - keeps the compiled statement if the sql holds only one.
+// It is compiled on the first execution, the tables may not exist before.
+func (s *Stmt) compile() error {
+	psql := s.psql
+	pstmt, err := s.c.prepareV2(&psql)
+	if err != nil {
+		return err
+	}
+	for *(*byte)(unsafe.Pointer(psql)) != 0 {
+		next, err := s.c.prepareV2(&psql)
+		if err == nil && next == 0 {
+			// white space or comments
+			continue
+		}
+		if next != 0 {
+			s.c.finalize(next)
+		}
+		if pstmt != 0 {
+			s.c.finalize(pstmt)
+		}
+		// the next statements may depend on the first one
+		s.multi = true
+		return nil
+	}
+	if pstmt == 0 {
+		s.multi = true
+		return nil
+	}
+	s.pstmt = pstmt
+	return nil
+}
+
+// execCompiled - runs the kept statement and resets it for the next execution
+func (s *Stmt) execCompiled(args []driver.NamedValue) (err error) {
+	n, err := s.c.bindParameterCount(s.pstmt)
+	if err != nil {
+		return err
+	}
+	var allocs []uintptr
+	if n != 0 {
+		allocs, err = s.c.bind(s.pstmt, n, args)
+		if err != nil {
+			sqlite3.Xsqlite3_clear_bindings(s.c.tls, s.pstmt)
+			return err
+		}
+	}
+
+	rc, err := s.c.step(s.pstmt)
+	// the bound values are freed after the statement releases them
+	sqlite3.Xsqlite3_reset(s.c.tls, s.pstmt)
+	sqlite3.Xsqlite3_clear_bindings(s.c.tls, s.pstmt)
+	for _, v := range allocs {
+		s.c.free(v)
+	}
+	if err != nil {
+		return err
+	}
+	switch rc & 0xff {
+	case sqlite3.SQLITE_DONE, sqlite3.SQLITE_ROW:
+		return nil
+	}
+	return s.c.errstr(int32(rc))
+}
+
+func (s *Stmt) execAll(args []driver.NamedValue) (err error) {
 	var pstmt uintptr
 	var done int32
 
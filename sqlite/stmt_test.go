@@ -0,0 +1,121 @@
+package sqlite
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// stmtRuns - tests run so far, the in-memory database outlives a test
+var stmtRuns int
+
+// testTable - new table name of the test run
+func testTable(t *testing.T, name string) string {
+	t.Helper()
+	stmtRuns++
+	return fmt.Sprintf("stmt%d_%s", stmtRuns, name)
+}
+
+func tableRows(t *testing.T, c *Conn, table string) [][]any {
+	t.Helper()
+	rows, err := c.Query("SELECT * FROM " + table + " ORDER BY 1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var list [][]any
+	for rows.Next() {
+		vals, err := rows.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, vals)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestStmtCompiled(t *testing.T) {
+	c, err := NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	table := testTable(t, "single")
+
+	// the table is created after the statement, it is compiled on the first execution
+	insert, err := c.Prepare("INSERT INTO " + table + " VALUES (?, ?); -- trailing comment\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer insert.Close()
+	err = c.Exec("CREATE TABLE " + table + " (id INTEGER NOT NULL, name TEXT);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []any{"a", []byte("b"), nil} {
+		err = insert.Exec(int64(i+1), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if insert.pstmt == 0 || insert.multi {
+			t.Fatalf("statement is not kept compiled")
+		}
+	}
+	// a failed execution resets the statement for the next one
+	err = insert.Exec(nil, "x")
+	if err == nil {
+		t.Error("not null error expected")
+	}
+	err = insert.Exec(int64(4), "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]any{{int64(1), "a"}, {int64(2), []byte("b")}, {int64(3), nil}, {int64(4), "d"}}
+	if rows := tableRows(t, c, table); !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows %v, want %v", rows, want)
+	}
+}
+
+func TestStmtMulti(t *testing.T) {
+	c, err := NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	table := testTable(t, "multi")
+
+	// the insert can't be compiled before the create has run
+	s, err := c.Prepare(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER); INSERT INTO %s VALUES (?);", table, table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 1; i <= 2; i++ {
+		err = s.Exec(int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !s.multi || s.pstmt != 0 {
+			t.Fatalf("statements are kept compiled")
+		}
+	}
+	want := [][]any{{int64(1)}, {int64(2)}}
+	if rows := tableRows(t, c, table); !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows %v, want %v", rows, want)
+	}
+
+	// only white space and comments
+	empty, err := c.Prepare("  -- nothing\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	err = empty.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+}